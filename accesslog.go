@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Access log
+// *********************************************************
+
+// AccessLogEntry is one line of the -access-log file.
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+	Bytes      int64     `json:"bytes"`
+	RequestID  string    `json:"request_id"`
+	IP         string    `json:"ip"`
+}
+
+// accessLog writes every request as a JSON object on a line of its own, apart from the app log and without its
+// sampling and excluded paths. It is nil unless -access-log is set.
+var accessLog *accessLogWriter
+
+type accessLogWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// openAccessLog opens -access-log: "-" is stdout, anything else a file that is appended to. The file is closed by a
+// shutdown hook.
+func openAccessLog(path string) (*accessLogWriter, error) {
+	if path == "-" {
+		return &accessLogWriter{out: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	onShutdown("access log", func(ctx context.Context) error {
+		return file.Close()
+	})
+
+	return &accessLogWriter{out: file}, nil
+}
+
+func (l *accessLogWriter) write(entry AccessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not write the access log")
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err = l.out.Write(append(line, '\n'))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not write the access log")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogLineIsJSON(t *testing.T) {
+	var out bytes.Buffer
+	previous := accessLog
+	accessLog = &accessLogWriter{out: &out}
+	t.Cleanup(func() { accessLog = previous })
+
+	handler := requestIDMiddleware(loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})))
+	r := httptest.NewRequest(http.MethodPost, "/admin/flags/new-greeting", nil)
+	w := serve(handler, r)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d access log lines, want 1:\n%s", len(lines), out.String())
+	}
+	var entry AccessLogEntry
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Method != http.MethodPost || entry.Path != "/admin/flags/new-greeting" || entry.Status != http.StatusCreated || entry.Bytes != 7 {
+		t.Errorf("got entry %+v", entry)
+	}
+	if entry.RequestID == "" || entry.RequestID != w.Header().Get("X-Request-ID") {
+		t.Errorf("got request id %q, want %q", entry.RequestID, w.Header().Get("X-Request-ID"))
+	}
+	if entry.IP != "192.0.2.1" || entry.DurationMs < 0 || time.Since(entry.Time) > time.Minute {
+		t.Errorf("got entry %+v", entry)
+	}
+}
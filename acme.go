@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"path/filepath"
+)
+
+// *********************************************************
+// Certificates from an ACME CA, e.g. Let's Encrypt
+// *********************************************************
+
+// acmeManager gets and renews the certificates for -acme-domains. It is nil when they are not set.
+var acmeManager *autocert.Manager
+
+// newACMEManager accepts the terms of service of the CA on behalf of the operator, who opted in with -acme-domains.
+func newACMEManager(c Config) (*autocert.Manager, error) {
+	cacheDir := c.ACMECacheDir
+	if cacheDir == "" {
+		dir, err := dataDir()
+		if err != nil {
+			return nil, err
+		}
+		cacheDir = filepath.Join(dir, "acme")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      c.ACMEEmail,
+	}
+	if c.ACMEDirectory != "" {
+		manager.Client = &acme.Client{DirectoryURL: c.ACMEDirectory}
+	}
+
+	return manager, nil
+}
+
+// serverAddr is where the main server listens. With -acme-domains it has to be reachable by the CA, so it listens on
+// -acme-addr instead of the local development address.
+func serverAddr() string {
+	if acmeManager != nil {
+		return config.ACMEAddr
+	}
+
+	return "127.0.0.1:8081"
+}
+
+func validateACMEConfig(c Config) error {
+	if len(c.ACMEDomains) == 0 {
+		return nil
+	}
+	if c.TLSCert != "" || c.TLSKey != "" {
+		return fmt.Errorf("-acme-domains can't be combined with -tls-cert and -tls-key")
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestACMEManagerWiredForDomains(t *testing.T) {
+	// A fake ACME directory, the manager only has to find it
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := "http://" + r.Host
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"newNonce":"` + base + `/nonce","newAccount":"` + base + `/account","newOrder":"` + base + `/order"}`))
+	}))
+	defer directory.Close()
+
+	c := config
+	c.ACMEDomains = []string{"example.com"}
+	c.ACMEDirectory = directory.URL
+	c.ACMECacheDir = t.TempDir()
+	withConfig(t, c)
+
+	manager, err := newACMEManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := acmeManager
+	acmeManager = manager
+	t.Cleanup(func() { acmeManager = previous })
+
+	discovered, err := manager.Client.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discovered.OrderURL != directory.URL+"/order" {
+		t.Fatalf("got order URL %q from the fake directory", discovered.OrderURL)
+	}
+	if manager.HostPolicy(context.Background(), "example.com") != nil {
+		t.Error("configured domain not allowed")
+	}
+	if manager.HostPolicy(context.Background(), "other.example") == nil {
+		t.Error("other domain allowed")
+	}
+
+	settings, err := buildTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings == nil || settings.GetCertificate == nil {
+		t.Fatal("TLS config doesn't get its certificates from the manager")
+	}
+	if serverAddr() != config.ACMEAddr {
+		t.Errorf("got server address %q, want %q", serverAddr(), config.ACMEAddr)
+	}
+}
+
+func TestNoACMEManagerWithoutDomains(t *testing.T) {
+	previous := acmeManager
+	acmeManager = nil
+	t.Cleanup(func() { acmeManager = previous })
+
+	settings, err := buildTLSConfig(Config{})
+	if err != nil || settings != nil {
+		t.Fatalf("got %v %v, want no TLS config", settings, err)
+	}
+	if serverAddr() != "127.0.0.1:8081" {
+		t.Errorf("got server address %q", serverAddr())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/rs/zerolog/log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// *********************************************************
+// Admin endpoints
+// *********************************************************
+
+// adminTokenMiddleware only lets requests through that send "Authorization: Bearer <admin token>".
+func adminTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			writeError(w, http.StatusForbidden, "admin endpoints are disabled, start the server with -admin-token")
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), auditActorContextKey{}, "admin token from "+clientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// migrateHandler runs any migration scripts that are newer than the database, see migrateDatabase.
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+	dbVersion, err := migrateDatabase(r.Context(), getDB())
+	audit(r.Context(), "migrate", "database", auditResult(err))
+	if err != nil {
+		log.Error().Err(err).Msg("Migration failed")
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Version{Version: dbVersion})
+}
+
+// backupHandler sends a consistent copy of the database. VACUUM INTO writes the copy in a single read transaction,
+// so writes made while it runs don't end up half in it.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := os.MkdirTemp("", appName+"-backup-")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create a directory for the backup")
+		writeError(w, http.StatusInternalServerError, "could not create the backup")
+		return
+	}
+	defer func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not remove backup " + dir)
+		}
+	}()
+
+	backupFile := filepath.Join(dir, appName+".db")
+	start := time.Now()
+	_, err = getDB().ExecContext(r.Context(), "VACUUM INTO ?", backupFile)
+	logSlowQuery("VACUUM INTO", start)
+	audit(r.Context(), "backup", "database", auditResult(err))
+	if err != nil {
+		log.Error().Err(err).Msg("Backup failed")
+		writeError(w, http.StatusInternalServerError, "could not create the backup")
+		return
+	}
+
+	file, err := os.Open(backupFile)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not open backup " + backupFile)
+		writeError(w, http.StatusInternalServerError, "could not create the backup")
+		return
+	}
+	defer file.Close()
+
+	name := appName + "-" + start.UTC().Format("20060102T150405Z") + ".db"
+	log.Info().Msg("Sending database backup " + name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, start, file)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "secret"
+
+// withAdminConfig turns on the admin and debug routes for the test, on the main server.
+func withAdminConfig(t *testing.T) {
+	t.Helper()
+
+	c := config
+	c.AdminAddr = ""
+	c.AdminToken = testAdminToken
+	c.Debug = true
+	withConfig(t, c)
+}
+
+// adminRequest returns a request carrying the admin token.
+func adminRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return r
+}
+
+// adminJSONRequest returns a request with a JSON body carrying the admin token.
+func adminJSONRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// copySQLDir copies the embedded migration scripts to a directory that can be used as -sql-dir.
+func copySQLDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	entries, err := fs.ReadDir(sqlSource, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		content, err := fs.ReadFile(sqlSource, entry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, entry.Name()), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestMigrateEndpointRunsNewMigrations(t *testing.T) {
+	withAdminConfig(t)
+	config.SQLDir = copySQLDir(t)
+	db := openTestDB(t)
+
+	before, err := getCurrentDBVersion(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := before + 1
+	script := "create table added(id integer);\n\ninsert into version (version) values(" + strconv.FormatInt(next, 10) + ");"
+	err = os.WriteFile(filepath.Join(config.SQLDir, "v"+strconv.FormatInt(next, 10)+".sql"), []byte(script), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(newRoutes().handler, adminRequest(http.MethodPost, "/admin/migrate"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+
+	after, err := getCurrentDBVersion(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != next {
+		t.Fatalf("got database version %d, want %d", after, next)
+	}
+}
+
+func TestBackupIsAValidDatabase(t *testing.T) {
+	withAdminConfig(t)
+	openTestDB(t)
+
+	w := serve(newRoutes().handler, adminRequest(http.MethodGet, "/admin/backup"))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("got %d %s, want 200 application/octet-stream", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment; filename=") {
+		t.Fatalf("got Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+
+	backupFile := filepath.Join(t.TempDir(), "backup.db")
+	err := os.WriteFile(backupFile, w.Body.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := sql.Open(dbDriver, backupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	version, err := getCurrentDBVersion(context.Background(), backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestMigrationVersion() {
+		t.Fatalf("backup is at version %d, want %d", version, latestMigrationVersion())
+	}
+}
+
+func TestAdminActionIsAudited(t *testing.T) {
+	withAdminConfig(t)
+	config.AuditSinks = []string{auditSinkLog, auditSinkDatabase}
+	db := openTestDB(t)
+	withEventBus(t)
+	logged := captureLog(t)
+
+	r := adminJSONRequest(http.MethodPut, "/admin/flags/new-greeting", `{"enabled":true}`)
+	if w := serve(newRoutes().handler, r); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+
+	var actor, action, target, result string
+	err := db.QueryRow("select actor, action, target, result from audit_log").Scan(&actor, &action, &target, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != "flag.set" || target != "new-greeting" || result != "ok" || actor == "unknown" {
+		t.Fatalf("got audit entry %s %s %s %s", actor, action, target, result)
+	}
+	if !strings.Contains(logged.String(), `"action":"flag.set"`) {
+		t.Fatalf("audit entry not logged: %s", logged.String())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// *********************************************************
+// API versions
+// *********************************************************
+
+type apiVersionContextKey struct{}
+
+// apiVersionMiddleware requires an X-API-Version header with one of the supported versions: 400 when it is missing,
+// 406 when it isn't supported. The version is available to handlers through apiVersionFromContext. Without supported
+// versions every request is let through. Health checks never need the header.
+func apiVersionMiddleware(supported []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(supported) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasPathPrefix(r.URL.Path, alwaysAllowedPaths) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			requested := strings.TrimSpace(r.Header.Get("X-API-Version"))
+			if requested == "" {
+				writeError(w, http.StatusBadRequest, "the X-API-Version header is required, supported versions: "+strings.Join(supported, ", "))
+				return
+			}
+
+			for _, version := range supported {
+				if requested == version {
+					w.Header().Set("X-API-Version", version)
+					ctx := context.WithValue(r.Context(), apiVersionContextKey{}, version)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+
+			writeError(w, http.StatusNotAcceptable, "API version "+requested+" is not supported, supported versions: "+strings.Join(supported, ", "))
+		})
+	}
+}
+
+// apiVersionFromContext returns the version stored by apiVersionMiddleware, "" when versions aren't enforced.
+func apiVersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(apiVersionContextKey{}).(string)
+	return version
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIVersionHeader(t *testing.T) {
+	var negotiated string
+	handler := apiVersionMiddleware([]string{"1", "2"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		negotiated = apiVersionFromContext(r.Context())
+	}))
+
+	for version, status := range map[string]int{
+		"":  http.StatusBadRequest,
+		"3": http.StatusNotAcceptable,
+		"2": http.StatusOK,
+	} {
+		negotiated = ""
+		r := httptest.NewRequest(http.MethodGet, "/helloworld", nil)
+		if version != "" {
+			r.Header.Set("X-API-Version", version)
+		}
+		w := serve(handler, r)
+
+		if w.Code != status {
+			t.Errorf("version %q got %d, want %d", version, w.Code, status)
+		}
+		if status == http.StatusOK && (negotiated != version || w.Header().Get("X-API-Version") != version) {
+			t.Errorf("version %q was negotiated as %q", version, negotiated)
+		}
+	}
+
+	// Health checks don't need the header
+	if w := serve(handler, httptest.NewRequest(http.MethodGet, "/health", nil)); w.Code != http.StatusOK {
+		t.Errorf("/health without a version got %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// *********************************************************
+// Audit log
+// *********************************************************
+
+const (
+	auditSinkLog      = "log"
+	auditSinkDatabase = "db"
+)
+
+// AuditEntry records an admin action and how it ended.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Result    string    `json:"result"`
+	RequestID string    `json:"requestId"`
+}
+
+type auditActorContextKey struct{}
+
+// auditActorFromContext returns who adminTokenMiddleware let through, or "unknown".
+func auditActorFromContext(ctx context.Context) string {
+	actor, ok := ctx.Value(auditActorContextKey{}).(string)
+	if !ok {
+		return "unknown"
+	}
+
+	return actor
+}
+
+func validateAuditSinks(sinks []string) error {
+	for _, sink := range sinks {
+		if sink != auditSinkLog && sink != auditSinkDatabase {
+			return fmt.Errorf("unknown audit sink %q, use %s or %s", sink, auditSinkLog, auditSinkDatabase)
+		}
+	}
+
+	return nil
+}
+
+// audit writes an entry to every -audit-sinks sink. A sink that fails is logged, the action already happened.
+func audit(ctx context.Context, action string, target string, result string) {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Actor:     auditActorFromContext(ctx),
+		Action:    action,
+		Target:    target,
+		Result:    result,
+		RequestID: requestInfoFromContext(ctx).ID,
+	}
+
+	for _, sink := range configFromContext(ctx).AuditSinks {
+		switch sink {
+		case auditSinkLog:
+			log.Info().Bool("audit", true).Str("actor", entry.Actor).Str("action", entry.Action).Str("target", entry.Target).
+				Str("result", entry.Result).Str("request_id", entry.RequestID).Msg("Audit: " + entry.Action)
+		case auditSinkDatabase:
+			err := saveAuditEntry(entry)
+			if err != nil {
+				log.Error().Err(err).Str("action", entry.Action).Msg("Could not write the audit entry")
+			}
+		}
+	}
+}
+
+func saveAuditEntry(entry AuditEntry) error {
+	return withLockRetry(func() error {
+		// Not the request context, the entry should be written even when the client went away
+		_, err := execContext(context.Background(), "insert into audit_log(time, actor, action, target, result, request_id) values(?, ?, ?, ?, ?, ?)",
+			DBTime{entry.Time}, entry.Actor, entry.Action, entry.Target, entry.Result, entry.RequestID)
+		return err
+	})
+}
+
+// auditResult turns an error into the result column, "ok" when there is none.
+func auditResult(err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+
+	return "ok"
+}
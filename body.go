@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// *********************************************************
+// Request bodies
+// *********************************************************
+
+// bodyError is a request body problem that can be shown to the client as is.
+type bodyError struct {
+	status  int
+	message string
+}
+
+// decodeJSON decodes the JSON request body into dst. When the body isn't JSON, is too large or doesn't fit dst it
+// writes the 400, 413 or 415 response itself and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		writeError(w, http.StatusUnsupportedMediaType, "content type must be application/json")
+		return false
+	}
+
+	bodyErr := decodeJSONBody(w, r, dst)
+	if bodyErr != nil {
+		writeError(w, bodyErr.status, bodyErr.message)
+		return false
+	}
+
+	return true
+}
+
+// decodeJSONBody decodes a single JSON value from the body into dst. No more than -max-body-size bytes are ever held,
+// and a body nested deeper than -max-json-depth or with more than -max-json-tokens tokens is rejected before it is
+// decoded. Fields dst doesn't have are rejected.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) *bodyError {
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodySize)
+	var body bytes.Buffer
+	bodyErr := checkJSONShape(io.TeeReader(r.Body, &body), config.MaxJSONDepth, config.MaxJSONTokens)
+	if bodyErr != nil {
+		return bodyErr
+	}
+
+	decoder := json.NewDecoder(&body)
+	decoder.DisallowUnknownFields()
+	// Numbers decoded into an interface{} become json.Number instead of float64, which can't hold every int64
+	decoder.UseNumber()
+
+	err := decoder.Decode(dst)
+	if err != nil {
+		return jsonBodyError(err)
+	}
+
+	// Anything after the value, other than white space, is a mistake too
+	err = decoder.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return &bodyError{status: http.StatusBadRequest, message: "the body must contain a single JSON value"}
+	}
+
+	return nil
+}
+
+// checkJSONShape walks the first JSON value of body token by token, without building it, and fails when it is nested
+// deeper than maxDepth or has more than maxTokens tokens. Keys count as tokens. 0 turns a limit off. The rest of the
+// body is read as well, so a tee of body ends up with all of it.
+func checkJSONShape(body io.Reader, maxDepth, maxTokens int) *bodyError {
+	decoder := json.NewDecoder(body)
+	depth, tokens := 0, 0
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) && tokens > 0 {
+			// Token reports a body that stops inside a value as a plain EOF
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return jsonBodyError(err)
+		}
+
+		tokens++
+		if maxTokens > 0 && tokens > maxTokens {
+			return &bodyError{status: http.StatusBadRequest, message: fmt.Sprintf("the JSON body must not have more than %d tokens", maxTokens)}
+		}
+		if delim, ok := token.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				depth++
+				if maxDepth > 0 && depth > maxDepth {
+					return &bodyError{status: http.StatusBadRequest, message: fmt.Sprintf("the JSON body must not be nested deeper than %d levels", maxDepth)}
+				}
+			default:
+				depth--
+			}
+		}
+
+		if depth == 0 {
+			break
+		}
+	}
+
+	_, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return jsonBodyError(err)
+	}
+
+	return nil
+}
+
+func jsonBodyError(err error) *bodyError {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return &bodyError{status: http.StatusBadRequest, message: fmt.Sprintf("malformed JSON at offset %d: %s", syntaxError.Offset, syntaxError.Error())}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &bodyError{status: http.StatusBadRequest, message: "malformed JSON: the body ends in the middle of a value"}
+	case errors.As(err, &typeError):
+		return &bodyError{status: http.StatusBadRequest, message: fmt.Sprintf("field %q must be a JSON %s (offset %d)", typeError.Field, jsonKind(typeError.Type.Kind()), typeError.Offset)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for this
+		return &bodyError{status: http.StatusBadRequest, message: "unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")}
+	case errors.Is(err, io.EOF):
+		return &bodyError{status: http.StatusBadRequest, message: "the body must not be empty"}
+	case err.Error() == "http: request body too large":
+		// http.MaxBytesReader doesn't have an error type in this go version
+		return &bodyError{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("the body must not be larger than %d bytes", config.MaxBodySize)}
+	default:
+		return &bodyError{status: http.StatusBadRequest, message: "invalid JSON body: " + err.Error()}
+	}
+}
+
+// jsonKind names a go kind the way JSON does.
+func jsonKind(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return "number"
+	default:
+		return kind.String()
+	}
+}
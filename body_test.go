@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testBody struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// decodeTestBody runs decodeJSON on a request with the given body and returns the response it wrote, if any.
+func decodeTestBody(contentType, body string) (*httptest.ResponseRecorder, testBody, bool) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+
+	var dst testBody
+	ok := decodeJSON(w, r, &dst)
+	return w, dst, ok
+}
+
+func TestDecodeJSONStreaming(t *testing.T) {
+	w, dst, ok := decodeTestBody("application/json", `{"name":"new-greeting","enabled":true}`)
+	if !ok || dst.Name != "new-greeting" || !dst.Enabled {
+		t.Fatalf("valid body got %v %+v: %s", ok, dst, w.Body.String())
+	}
+
+	w, _, ok = decodeTestBody("application/json", `{"name":"new-greeting","colour":"red"}`)
+	if ok || w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `unknown field \"colour\"`) {
+		t.Errorf("unknown field got %d %s, want 400 naming the field", w.Code, w.Body.String())
+	}
+
+	w, _, ok = decodeTestBody("application/json", `{"name": nope}`)
+	if ok || w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "offset 11") {
+		t.Errorf("bad JSON got %d %s, want 400 with the offset", w.Code, w.Body.String())
+	}
+}
+
+func TestDecodeJSONFailures(t *testing.T) {
+	c := config
+	c.MaxBodySize = 64
+	withConfig(t, c)
+
+	for _, test := range []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"wrong content type", "text/plain", `{"name":"x"}`, http.StatusUnsupportedMediaType},
+		{"no content type", "", `{"name":"x"}`, http.StatusUnsupportedMediaType},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("x", 100) + `"}`, http.StatusRequestEntityTooLarge},
+		{"empty", "application/json", ``, http.StatusBadRequest},
+		{"cut off", "application/json", `{"name":"x"`, http.StatusBadRequest},
+		{"wrong type", "application/json", `{"enabled":"yes"}`, http.StatusBadRequest},
+		{"unknown field", "application/json", `{"colour":"red"}`, http.StatusBadRequest},
+		{"two values", "application/json", `{"name":"x"} {"name":"y"}`, http.StatusBadRequest},
+	} {
+		w, _, ok := decodeTestBody(test.contentType, test.body)
+		if ok || w.Code != test.status {
+			t.Errorf("%s: got %v %d %s, want %d", test.name, ok, w.Code, w.Body.String(), test.status)
+		}
+	}
+
+	w, dst, ok := decodeTestBody("application/merge-patch+json", `{"name":"x"}`)
+	if !ok || dst.Name != "x" {
+		t.Errorf("+json body got %v %+v: %s", ok, dst, w.Body.String())
+	}
+}
+
+func TestLargeIntegersRoundTrip(t *testing.T) {
+	c := config
+	c.ResponseEnvelope = false
+	withConfig(t, c)
+
+	// Doesn't fit the 53 bit mantissa of a float64
+	const large int64 = 1<<62 + 1
+	encoded := httptest.NewRecorder()
+	writeJSON(encoded, http.StatusOK, Version{Version: large})
+
+	decode := func(dst interface{}) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(encoded.Body.String()))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		if !decodeJSON(w, r, dst) {
+			t.Fatal(w.Body.String())
+		}
+	}
+
+	var version Version
+	decode(&version)
+	if version.Version != large {
+		t.Fatalf("got version %d, want %d", version.Version, large)
+	}
+
+	var generic map[string]interface{}
+	decode(&generic)
+	if number, ok := generic["version"].(json.Number); !ok || number.String() != "4611686018427387905" {
+		t.Fatalf("got %#v, want json.Number 4611686018427387905", generic["version"])
+	}
+}
+
+func TestDecodeJSONLimitsNestingAndTokens(t *testing.T) {
+	c := config
+	c.MaxJSONDepth = 5
+	c.MaxJSONTokens = 20
+	withConfig(t, c)
+
+	deep := strings.Repeat(`{"name":`, 6) + `"x"` + strings.Repeat("}", 6)
+	w, _, ok := decodeTestBody("application/json", deep)
+	if ok || w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "nested deeper than 5") {
+		t.Errorf("deep body got %d %s, want 400", w.Code, w.Body.String())
+	}
+
+	long := `{"name":"` + strings.Repeat("x", 100) + `","enabled":true}`
+	if _, dst, ok := decodeTestBody("application/json", long); !ok || len(dst.Name) != 100 {
+		t.Errorf("body within the limits was rejected")
+	}
+
+	var tokens strings.Builder
+	tokens.WriteString(`{"name":"x","enabled":true,"extra":[`)
+	for i := 0; i < 30; i++ {
+		tokens.WriteString(`1,`)
+	}
+	tokens.WriteString(`1]}`)
+	w, _, ok = decodeTestBody("application/json", tokens.String())
+	if ok || w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "more than 20 tokens") {
+		t.Errorf("body with too many tokens got %d %s, want 400", w.Code, w.Body.String())
+	}
+}
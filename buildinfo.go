@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// *********************************************************
+// Build info
+// *********************************************************
+
+// These are set at build time, for example:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// getBuildInfo returns the ldflags values, falling back to what the go toolchain embedded in the binary.
+func getBuildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate}
+
+	embedded, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info.GoVersion = embedded.GoVersion
+	if info.Version == "" {
+		info.Version = embedded.Main.Version
+	}
+
+	for _, setting := range embedded.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	return info
+}
+
+// String is what -version prints, e.g. "helloworldapp 1.2.0 (commit 0a1b2c3, built 2024-01-02T03:04:05Z, go1.21.5)".
+func (info BuildInfo) String() string {
+	return appName + " " + orUnknown(info.Version) + " (commit " + orUnknown(info.Commit) + ", built " + orUnknown(info.BuildDate) + ", " + orUnknown(info.GoVersion) + ")"
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+
+	return value
+}
+
+func buildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, getBuildInfo())
+}
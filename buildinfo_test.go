@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// setBuildVars sets the values ldflags would inject for the test.
+func setBuildVars(t *testing.T, v, c, date string) {
+	t.Helper()
+
+	previousVersion, previousCommit, previousDate := version, commit, buildDate
+	version, commit, buildDate = v, c, date
+	t.Cleanup(func() {
+		version, commit, buildDate = previousVersion, previousCommit, previousDate
+	})
+}
+
+func TestBuildInfoHandlerReturnsInjectedValues(t *testing.T) {
+	setBuildVars(t, "1.2.0", "0a1b2c3", "2024-01-02T03:04:05Z")
+
+	w := serve(http.HandlerFunc(buildInfoHandler), httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+
+	var info BuildInfo
+	err := json.Unmarshal(w.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.2.0" || info.Commit != "0a1b2c3" || info.BuildDate != "2024-01-02T03:04:05Z" {
+		t.Fatalf("got %+v, want the injected values", info)
+	}
+}
+
+func TestBuildInfoString(t *testing.T) {
+	info := BuildInfo{Version: "1.2.0", Commit: "0a1b2c3", GoVersion: "go1.21.5"}
+	if got, want := info.String(), appName+" 1.2.0 (commit 0a1b2c3, built unknown, go1.21.5)"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestVersionFlag runs main with -version in a copy of the test binary, as it exits the process.
+func TestVersionFlag(t *testing.T) {
+	if os.Getenv("TEST_VERSION_FLAG") == "1" {
+		os.Args = []string{appName, "-version"}
+		main()
+		// main returned instead of exiting with an error
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionFlag$")
+	cmd.Env = append(os.Environ(), "TEST_VERSION_FLAG=1")
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("-version failed: %v", err)
+	}
+	if want := getBuildInfo().String() + "\n"; string(output) != want {
+		t.Fatalf("-version printed %q, want %q", output, want)
+	}
+}
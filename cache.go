@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Response cache
+// *********************************************************
+
+// responseCache keeps recent responses for a short time, evicting the least recently used one when it is full.
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+	mutex      sync.Mutex
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key     string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{ttl: ttl, maxEntries: maxEntries, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *responseCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	response := element.Value.(*cachedResponse)
+	if now.After(response.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return response, true
+}
+
+func (c *responseCache) put(response *cachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[response.key]; ok {
+		element.Value = response
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[response.key] = c.order.PushFront(response)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// uncachedHeaders are never stored. The middleware around the cache sets them for each response, e.g. gzip's
+// Content-Encoding, and replaying them would describe a body the hit doesn't send.
+var uncachedHeaders = map[string]bool{
+	"X-Cache":          true,
+	"Content-Encoding": true,
+	"Content-Length":   true,
+	"Vary":             true,
+}
+
+// cacheMiddleware answers GET requests from the cache, keyed by path and query. Only 200 responses are cached.
+// "Cache-Control: no-cache" skips the cache and stores the fresh response. A ttl of 0 turns caching off.
+func cacheMiddleware(ttl time.Duration, maxEntries int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if ttl <= 0 || maxEntries <= 0 {
+			return next
+		}
+
+		cache := newResponseCache(ttl, maxEntries)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := r.URL.RequestURI()
+			if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+				if response, ok := cache.get(key, time.Now()); ok {
+					for name, values := range response.header {
+						w.Header()[name] = values
+					}
+					w.Header().Set("X-Cache", "HIT")
+					w.WriteHeader(http.StatusOK)
+					w.Write(response.body)
+					return
+				}
+			}
+
+			// Headers set before this middleware, like the CORS ones, belong to this request and aren't cached
+			before := w.Header().Clone()
+			w.Header().Set("X-Cache", "MISS")
+			recorder := &cacheRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+			next.ServeHTTP(recorder, r)
+
+			if recorder.Status() == http.StatusOK {
+				header := http.Header{}
+				for name, values := range w.Header() {
+					if !uncachedHeaders[name] && strings.Join(values, ",") != strings.Join(before[name], ",") {
+						header[name] = values
+					}
+				}
+				cache.put(&cachedResponse{key: key, header: header, body: recorder.body.Bytes(), expires: time.Now().Add(ttl)})
+			}
+		})
+	}
+}
+
+// cacheRecorder keeps a copy of the body it passes on.
+type cacheRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.statusRecorder.Write(b)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// countingHandler answers with a fixed body and counts how often it ran.
+func countingHandler(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Version", "1.2.0")
+		w.Write([]byte(`{"version":"1.2.0"}`))
+	})
+}
+
+func TestCacheReplaysResponseWithinTTL(t *testing.T) {
+	calls := 0
+	handler := cacheMiddleware(time.Minute, 10)(countingHandler(&calls))
+
+	first := serve(handler, httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+	second := serve(handler, httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("got X-Cache %q and %q, want MISS and HIT", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+	}
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Fatalf("got %d %q from the cache, want 200 %q", second.Code, second.Body.String(), first.Body.String())
+	}
+	for _, name := range []string{"Content-Type", "X-Version"} {
+		if second.Header().Get(name) != first.Header().Get(name) {
+			t.Errorf("got %s %q from the cache, want %q", name, second.Header().Get(name), first.Header().Get(name))
+		}
+	}
+}
+
+func TestCacheBypassedByNoCache(t *testing.T) {
+	calls := 0
+	handler := cacheMiddleware(time.Minute, 10)(countingHandler(&calls))
+
+	serve(handler, httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+	r := httptest.NewRequest(http.MethodGet, "/buildinfo", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	serve(handler, r)
+
+	if calls != 2 {
+		t.Fatalf("handler ran %d times, want 2", calls)
+	}
+}
+
+func TestCacheBehindGzip(t *testing.T) {
+	calls := 0
+	handler := gzipMiddleware(gzip.DefaultCompression)(cacheMiddleware(time.Minute, 10)(countingHandler(&calls)))
+
+	compressed := httptest.NewRequest(http.MethodGet, "/buildinfo", nil)
+	compressed.Header.Set("Accept-Encoding", "gzip")
+	serve(handler, compressed)
+
+	// A hit for a client that doesn't accept gzip has to be sent as is
+	plain := serve(handler, httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+	if plain.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("expected a cache hit")
+	}
+	if encoding := plain.Header().Get("Content-Encoding"); encoding != "" {
+		t.Fatalf("got Content-Encoding %q on an uncompressed hit", encoding)
+	}
+	if plain.Body.String() != `{"version":"1.2.0"}` {
+		t.Fatalf("got body %q", plain.Body.String())
+	}
+
+	// And a hit for one that does is compressed once
+	compressed = httptest.NewRequest(http.MethodGet, "/buildinfo", nil)
+	compressed.Header.Set("Accept-Encoding", "gzip")
+	hit := serve(handler, compressed)
+	if hit.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected a compressed hit")
+	}
+	reader, err := gzip.NewReader(hit.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"version":"1.2.0"}` {
+		t.Fatalf("got body %q", body)
+	}
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// *********************************************************
+// Response compression
+// *********************************************************
+
+// validateCompressionLevel accepts gzip.DefaultCompression and gzip.NoCompression through gzip.BestCompression.
+// gzip.NoCompression turns compression off.
+func validateCompressionLevel(level int) error {
+	if level == gzip.DefaultCompression || (level >= gzip.NoCompression && level <= gzip.BestCompression) {
+		return nil
+	}
+
+	return fmt.Errorf("compression level must be between %d and %d, or %d for the default", gzip.NoCompression, gzip.BestCompression, gzip.DefaultCompression)
+}
+
+// gzipMiddleware compresses responses for clients that accept gzip. Writers are pooled, since setting one up at a
+// high level allocates a lot.
+func gzipMiddleware(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if level == gzip.NoCompression {
+			return next
+		}
+
+		pool := sync.Pool{New: func() interface{} {
+			// The level was validated on startup, so this can't fail
+			writer, _ := gzip.NewWriterLevel(io.Discard, level)
+			return writer
+		}}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			// Compressing part of a file would make the Content-Range header wrong
+			if !acceptsGzip(r) || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gzipWriter := &gzipResponseWriter{ResponseWriter: w, pool: &pool}
+			defer gzipWriter.close()
+			next.ServeHTTP(gzipWriter, r)
+		})
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gzipResponseWriter holds back the status until the first Write, so it can sniff the content type of the
+// uncompressed body. Responses without a body and responses a handler already encoded are passed through untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	pool        *sync.Pool
+	writer      *gzip.Writer
+	status      int
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.start(b)
+	}
+
+	if g.writer == nil {
+		return g.ResponseWriter.Write(b)
+	}
+
+	return g.writer.Write(b)
+}
+
+// start sends the headers, switching to gzip when there is a body to compress.
+func (g *gzipResponseWriter) start(body []byte) {
+	g.wroteHeader = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+
+	header := g.Header()
+	if len(body) > 0 && g.status != http.StatusNoContent && g.status != http.StatusNotModified && header.Get("Content-Encoding") == "" {
+		if header.Get("Content-Type") == "" {
+			// net/http would otherwise sniff the compressed bytes
+			header.Set("Content-Type", http.DetectContentType(body))
+		}
+		header.Set("Content-Encoding", "gzip")
+		// The length of the compressed body isn't known up front
+		header.Del("Content-Length")
+		g.writer = g.pool.Get().(*gzip.Writer)
+		g.writer.Reset(g.ResponseWriter)
+	}
+
+	g.ResponseWriter.WriteHeader(g.status)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if !g.wroteHeader {
+		g.start(nil)
+	}
+	if g.writer != nil {
+		g.writer.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) close() {
+	if !g.wroteHeader {
+		if g.status == 0 {
+			// The handler didn't write anything, let net/http send its default response
+			return
+		}
+		g.start(nil)
+	}
+	if g.writer == nil {
+		return
+	}
+
+	err := g.writer.Close()
+	if err != nil {
+		log.Debug().Err(err).Msg("Could not finish the gzip response")
+	}
+	g.writer.Reset(io.Discard)
+	g.pool.Put(g.writer)
+	g.writer = nil
+}
+
+// *********************************************************
+// Request decompression
+// *********************************************************
+
+// decompressRequestMiddleware lets clients send gzip request bodies, handlers read them decompressed. maxSize limits
+// the decompressed size, so a small compressed body can't expand into a huge one. Other encodings get a 415.
+func decompressRequestMiddleware(maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			switch encoding {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip":
+			default:
+				w.Header().Set("Accept-Encoding", "gzip")
+				writeError(w, http.StatusUnsupportedMediaType, "content encoding "+encoding+" is not supported, use gzip")
+				return
+			}
+
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "malformed gzip body: "+err.Error())
+				return
+			}
+			defer reader.Close()
+
+			r.Body = http.MaxBytesReader(w, reader, maxSize)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			// The decompressed length isn't known up front
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// *********************************************************
+// Compressed files
+// *********************************************************
+
+// gunzipFS serves name from name.gz, decompressed, when only the compressed copy exists. Files without a .gz copy
+// are served as they are.
+type gunzipFS struct {
+	fs.FS
+}
+
+func (g gunzipFS) Open(name string) (fs.File, error) {
+	file, err := g.FS.Open(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+
+	compressed, gzErr := g.FS.Open(name + ".gz")
+	if gzErr != nil {
+		// The error for the name that was asked for
+		return nil, err
+	}
+	defer compressed.Close()
+
+	info, err := compressed.Stat()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name + ".gz", Err: err}
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name + ".gz", Err: err}
+	}
+
+	return &gunzippedFile{Reader: bytes.NewReader(data), info: gunzippedInfo{FileInfo: info, name: path.Base(name), size: int64(len(data))}}, nil
+}
+
+// gunzippedFile is a decompressed file held in memory.
+type gunzippedFile struct {
+	*bytes.Reader
+	info gunzippedInfo
+}
+
+func (f *gunzippedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *gunzippedFile) Close() error {
+	return nil
+}
+
+// gunzippedInfo is the info of the .gz file with the name and size of the decompressed one.
+type gunzippedInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i gunzippedInfo) Name() string {
+	return i.name
+}
+
+func (i gunzippedInfo) Size() int64 {
+	return i.size
+}
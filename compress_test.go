@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// compressibleText returns text made of random words, which gzip levels compress to noticeably different sizes.
+func compressibleText() string {
+	words := []string{"hello", "world", "sqlite", "server", "request", "response", "gzip", "level", "route", "cache"}
+	random := rand.New(rand.NewSource(1))
+	var builder strings.Builder
+	for i := 0; i < 20000; i++ {
+		builder.WriteString(words[random.Intn(len(words))])
+		builder.WriteByte(' ')
+	}
+
+	return builder.String()
+}
+
+func compressedSize(t *testing.T, level int, body string) int {
+	t.Helper()
+
+	handler := gzipMiddleware(level)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := serve(handler, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("level %d didn't compress the response", level)
+	}
+
+	return w.Body.Len()
+}
+
+func TestCompressionLevel(t *testing.T) {
+	body := compressibleText()
+
+	best := compressedSize(t, gzip.BestCompression, body)
+	fastest := compressedSize(t, gzip.BestSpeed, body)
+	if best >= fastest {
+		t.Fatalf("best compression gave %d bytes, best speed %d, want it smaller", best, fastest)
+	}
+}
+
+func TestValidateCompressionLevel(t *testing.T) {
+	for _, level := range []int{gzip.DefaultCompression, gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression} {
+		if err := validateCompressionLevel(level); err != nil {
+			t.Errorf("level %d: %v", level, err)
+		}
+	}
+	for _, level := range []int{-2, 10} {
+		if err := validateCompressionLevel(level); err == nil {
+			t.Errorf("level %d was accepted", level)
+		}
+	}
+}
+
+func TestGzipRequestBodyIsDecompressed(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"enabled":true}`))
+	writer.Close()
+
+	var received string
+	handler := decompressRequestMiddleware(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		received = string(body)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressed.Bytes()))
+	r.Header.Set("Content-Encoding", "gzip")
+	if w := serve(handler, r); w.Code != http.StatusOK || received != `{"enabled":true}` {
+		t.Fatalf("got %d with body %q, want the decompressed body", w.Code, received)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	if w := serve(handler, r); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed gzip got %d, want 400", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	r.Header.Set("Content-Encoding", "br")
+	if w := serve(handler, r); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("brotli body got %d, want 415", w.Code)
+	}
+
+	// The limit applies to the decompressed size
+	compressed.Reset()
+	writer = gzip.NewWriter(&compressed)
+	writer.Write([]byte(strings.Repeat(" ", 4096)))
+	writer.Close()
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressed.Bytes()))
+	r.Header.Set("Content-Encoding", "gzip")
+	if w := serve(handler, r); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body expanding past the limit got %d, want 413", w.Code)
+	}
+}
+
+func TestGzippedMigrationsAreDecompressed(t *testing.T) {
+	script := "create table gzipped(id integer);\n\ninsert into version (version) values(1);"
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(script))
+	writer.Close()
+
+	previous := sqlSource
+	sqlSource = fstest.MapFS{
+		"init.sql":  {Data: []byte("create table version(version integer);")},
+		"v1.sql.gz": {Data: compressed.Bytes()},
+	}
+	t.Cleanup(func() { sqlSource = previous })
+
+	if text := getSqlFileText("v1.sql"); text != script {
+		t.Fatalf("got %q from v1.sql.gz, want %q", text, script)
+	}
+	if text := getSqlFileText("init.sql"); text != "create table version(version integer);" {
+		t.Fatalf("got %q from the plain init.sql", text)
+	}
+	info, err := fs.Stat(migrationFiles(), "v1.sql")
+	if err != nil || info.Name() != "v1.sql" || info.Size() != int64(len(script)) {
+		t.Fatalf("got %v %v, want the decompressed file's name and size", info, err)
+	}
+	if latestMigrationVersion() != 1 {
+		t.Fatalf("got latest version %d, want the gzipped migration counted", latestMigrationVersion())
+	}
+}
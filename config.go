@@ -0,0 +1,555 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *********************************************************
+// Configuration
+// *********************************************************
+
+// Config holds the settings that can be changed with command line flags.
+type Config struct {
+	// Debug turns on debug logging and the /debug endpoints.
+	Debug bool
+	// DebugRequests is the number of requests kept for /debug/requests.
+	DebugRequests int
+	// LogClientHeaders adds the User-Agent and Referer headers to the request log.
+	LogClientHeaders bool
+	// AccessLog is a file every request is appended to as a line of JSON, "-" for stdout. Empty turns it off.
+	AccessLog string
+	// LogExcludePaths are path prefixes left out of the request log, unless the request fails or is slow.
+	LogExcludePaths []string
+	// LogSampleRate logs 1 in this many requests at info level. Failed and slow requests are always logged.
+	LogSampleRate int
+	// SlowRequest is how long a request can take before it is always logged, 0 turns it off.
+	SlowRequest time.Duration
+	// PprofRequireToken makes /debug/pprof/ require the admin token.
+	PprofRequireToken bool
+	// DumpOnSignal logs the resolved config and the routes when the process gets SIGUSR1.
+	DumpOnSignal bool
+	// StatsRequireToken makes /debug/stats require the admin token.
+	StatsRequireToken bool
+	// Env names the environment the app is running in, e.g. development or production. envDefaults changes some
+	// defaults for it.
+	Env string
+	// DBLockRetries is how many more times a write is attempted when sqlite reports the database is locked.
+	DBLockRetries      int
+	DBLockRetryBackoff time.Duration
+	// MigrationRetries is how many more times the pending migrations are run after a transient database error, e.g.
+	// a busy database. Other errors stop the migration right away.
+	MigrationRetries      int
+	MigrationRetryBackoff time.Duration
+	// KeepAlives turns HTTP keep-alive connections and TCP keep-alive probes on or off.
+	KeepAlives      bool
+	KeepAlivePeriod time.Duration
+	// ShutdownGrace is how long open connections get to finish on shutdown before they are closed.
+	ShutdownGrace time.Duration
+	// ReusePort sets SO_REUSEPORT on the listener so several processes can serve the same port.
+	ReusePort bool
+	// MaxConnsPerIP limits the open connections from one client IP, 0 turns the limit off.
+	MaxConnsPerIP int
+	// DataDirMode is the permission mode of the directory holding the database.
+	DataDirMode os.FileMode
+	// JournalMode, ForeignKeys and BusyTimeout are applied as sqlite pragmas on every connection.
+	JournalMode string
+	ForeignKeys bool
+	BusyTimeout time.Duration
+	// StartupTimeout limits how long startup waits for the database version checks.
+	StartupTimeout time.Duration
+	// SlowQuery is how long a query can take before it is logged as slow.
+	SlowQuery time.Duration
+	// StatementCacheSize is how many prepared statements are kept for reuse, 0 prepares every query again.
+	StatementCacheSize int
+	// FlagCacheTTL is how long a feature flag is cached before it is read from the database again.
+	FlagCacheTTL time.Duration
+	// EventBuffer is how many events a subscriber can fall behind before new ones are dropped for it.
+	EventBuffer int
+	// EventDrainTimeout is how long shutdown waits for queued webhook deliveries. Ones still queued then are dropped.
+	EventDrainTimeout time.Duration
+	// WebhookURLs receive a POST with every event on WebhookTopics (every topic when it is empty).
+	WebhookURLs    []string
+	WebhookTopics  []string
+	WebhookWorkers int
+	// WebhookTimeout limits a single delivery attempt. Failed deliveries are retried WebhookRetries times, waiting
+	// WebhookBackoff before the first retry and twice as long before each further one.
+	WebhookTimeout time.Duration
+	WebhookRetries int
+	WebhookBackoff time.Duration
+	// WebhookBreakerFailures consecutive failed attempts open the circuit breaker of a webhook URL. While it is open
+	// deliveries to the URL are dropped, or held back with WebhookBreakerQueue, until WebhookBreakerCooldown has
+	// passed and a trial delivery succeeds.
+	WebhookBreakerFailures int
+	WebhookBreakerCooldown time.Duration
+	WebhookBreakerQueue    bool
+	// StaticDir replaces the embedded ui directory with a directory on disk when set.
+	StaticDir string
+	// AllowedHosts are the Host header values the server answers, e.g. example.com or *.example.com. Requests for other
+	// hosts get a 400. The check is off while it is empty.
+	AllowedHosts []string
+	// DisabledMethods are HTTP methods the main server answers with a 405 on every path but the MethodExemptPaths
+	// prefixes, e.g. POST,PUT,PATCH,DELETE for a read-only instance.
+	DisabledMethods   []string
+	MethodExemptPaths []string
+	// AllowedPaths limits the server to these path prefixes when it isn't empty.
+	AllowedPaths []string
+	// CorsOverrides pick a CORS policy by path prefix ("/admin=none") instead of the route group's policy.
+	CorsOverrides []string
+	// SQLDir replaces the embedded sql directory with a directory on disk when set.
+	SQLDir string
+	// AdminToken is the bearer token the /admin endpoints require. They refuse every request while it is empty.
+	AdminToken string
+	// AuditSinks are where admin actions are recorded: "log" and "db" (the audit_log table).
+	AuditSinks []string
+	// AdminAddr moves the /admin and debug endpoints to a second server on this address, e.g. 127.0.0.1:9091.
+	AdminAddr string
+	// Locales are the locales responses can be localized to, the first one is the fallback.
+	Locales []string
+	// PageSizes override the default and max page size of list endpoints, as resource=default:max values.
+	PageSizes []string
+	// SessionCookie names the cookie with the session id. Sessions expire SessionTTL after they were last saved.
+	SessionCookie string
+	SessionTTL    time.Duration
+	// SecureCookies marks the session and CSRF cookies Secure even for requests that didn't come over https.
+	SecureCookies bool
+	// DefaultCharset adds "; charset=utf-8" to text and JSON content types that don't name a charset.
+	DefaultCharset bool
+	// ResponseEnvelope wraps JSON responses in {"data": ..., "error": ...}.
+	ResponseEnvelope bool
+	// CacheTTL is how long cached responses of read heavy endpoints are reused, 0 turns the cache off. It holds up to
+	// CacheEntries responses.
+	CacheTTL     time.Duration
+	CacheEntries int
+	// APIVersions are the values of the X-API-Version header the API accepts. The header isn't required when it is
+	// empty.
+	APIVersions []string
+	// ContentTypes are the media types accepted in the body of POST, PUT and PATCH requests to the API.
+	ContentTypes []string
+	// RateLimit is how many requests a client can make per RateLimitWindow, 0 turns the limit off. RateLimitStore is
+	// where the counts are kept: "memory" or "sqlite" (the rate_limits table, shared by processes using the same
+	// database).
+	RateLimit       int
+	RateLimitWindow time.Duration
+	RateLimitStore  string
+	// MaxConcurrent limits the requests handled at the same time, 0 turns the limit off. Requests over the limit wait
+	// up to MaxQueueWait for a slot.
+	MaxConcurrent int
+	MaxQueueWait  time.Duration
+	// MaxBodySize is the largest request body, in bytes, handlers read.
+	MaxBodySize int64
+	// MaxJSONDepth and MaxJSONTokens limit how deeply nested a JSON request body can be and how many tokens (values,
+	// keys and brackets) it can have. 0 turns a limit off.
+	MaxJSONDepth  int
+	MaxJSONTokens int
+	// MaxPathSegments is the most segments a path can have, deeper ones get a 400.
+	MaxPathSegments int
+	// MaxURLLength is the longest URL accepted, longer ones get a 414.
+	MaxURLLength int
+	// CompressionLevel is the gzip level for responses, from gzip.BestSpeed to gzip.BestCompression. gzip.NoCompression
+	// turns compression off.
+	CompressionLevel int
+	// TrustedProxies are the addresses of reverse proxies whose X-Forwarded-* headers are believed.
+	TrustedProxies []string
+	// HTTPSRedirect redirects requests a trusted proxy received over plain http to https.
+	HTTPSRedirect bool
+	// TLSCert and TLSKey are PEM files. The server speaks https when they are set.
+	TLSCert string
+	TLSKey  string
+	// ACMEDomains get their certificates from an ACME CA, Let's Encrypt unless ACMEDirectory is set. The server then
+	// listens on ACMEAddr and answers the HTTP-01 challenges on ACMEHTTPAddr. Certificates are kept in ACMECacheDir,
+	// acme/ in the data directory by default.
+	ACMEDomains   []string
+	ACMEEmail     string
+	ACMEDirectory string
+	ACMECacheDir  string
+	ACMEAddr      string
+	ACMEHTTPAddr  string
+	// TLSCipherSuites and TLSCurves restrict the TLS 1.2 cipher suites and the key exchange curves.
+	TLSCipherSuites []string
+	TLSCurves       []string
+	// HSTSMaxAge is sent in the Strict-Transport-Security header on https responses, 0 leaves the header out.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubDomains bool
+}
+
+// config holds the defaults until parseFlags() is called from main().
+var config = Config{
+	DebugRequests:          100,
+	LogExcludePaths:        []string{"/health", "/metrics"},
+	LogSampleRate:          1,
+	SlowRequest:            time.Second,
+	Env:                    "development",
+	DBLockRetries:          5,
+	DBLockRetryBackoff:     50 * time.Millisecond,
+	MigrationRetries:       3,
+	DumpOnSignal:           true,
+	DefaultCharset:         true,
+	SessionCookie:          "session",
+	SessionTTL:             24 * time.Hour,
+	MigrationRetryBackoff:  time.Second,
+	KeepAlives:             true,
+	KeepAlivePeriod:        15 * time.Second,
+	ShutdownGrace:          10 * time.Second,
+	DataDirMode:            0754,
+	JournalMode:            "WAL",
+	ForeignKeys:            true,
+	BusyTimeout:            5 * time.Second,
+	StartupTimeout:         time.Minute,
+	SlowQuery:              200 * time.Millisecond,
+	StatementCacheSize:     64,
+	FlagCacheTTL:           10 * time.Second,
+	EventBuffer:            100,
+	EventDrainTimeout:      5 * time.Second,
+	WebhookWorkers:         4,
+	WebhookTimeout:         5 * time.Second,
+	WebhookRetries:         3,
+	WebhookBackoff:         time.Second,
+	WebhookBreakerFailures: 5,
+	WebhookBreakerCooldown: 30 * time.Second,
+	Locales:                []string{"en"},
+	CacheTTL:               10 * time.Second,
+	CacheEntries:           1000,
+	ContentTypes:           []string{"application/json"},
+	MaxQueueWait:           time.Second,
+	RateLimitWindow:        time.Minute,
+	RateLimitStore:         rateLimitStoreMemory,
+	MaxBodySize:            1 << 20,
+	MaxJSONDepth:           32,
+	MaxJSONTokens:          10000,
+	MaxPathSegments:        32,
+	MaxURLLength:           8192,
+	CompressionLevel:       gzip.DefaultCompression,
+	AuditSinks:             []string{auditSinkLog},
+	ACMEAddr:               ":443",
+	ACMEHTTPAddr:           ":80",
+	HSTSMaxAge:             180 * 24 * time.Hour,
+}
+
+// showVersion and checkMigrations are set by -version and -validate-migrations. main then prints the build info or
+// validates the migrations and exits instead of starting the server.
+var (
+	showVersion     bool
+	checkMigrations bool
+)
+
+func parseFlags() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n\nServes the hello world app. Flags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.BoolVar(&showVersion, "version", false, "Print the version and build info, then exit")
+	flag.BoolVar(&checkMigrations, "validate-migrations", false, "Run every migration against a new in-memory database, report each one and exit, 1 when one fails (the real database isn't touched)")
+	flag.BoolVar(&config.Debug, "debug", config.Debug, "Log at debug level and enable the /debug endpoints")
+	flag.IntVar(&config.DebugRequests, "debug-requests", config.DebugRequests, "Number of recent requests /debug/requests returns")
+	flag.BoolVar(&config.LogClientHeaders, "log-client-headers", config.LogClientHeaders, "Add the User-Agent and Referer headers to the request log")
+	flag.StringVar(&config.AccessLog, "access-log", config.AccessLog, "File every request is appended to as a JSON line (time, method, path, status, duration_ms, bytes, request_id, ip), - for stdout")
+	flag.Var((*stringListValue)(&config.LogExcludePaths), "log-exclude-paths", "Comma separated path prefixes left out of the request log, failed and slow requests are still logged")
+	flag.IntVar(&config.LogSampleRate, "log-sample-rate", config.LogSampleRate, "Log 1 in this many requests, errors and slow requests are always logged")
+	flag.DurationVar(&config.SlowRequest, "slow-request", config.SlowRequest, "Always log requests that take longer than this (0 turns it off)")
+	flag.BoolVar(&config.PprofRequireToken, "pprof-require-token", config.PprofRequireToken, "Require the -admin-token for /debug/pprof/")
+	flag.BoolVar(&config.DumpOnSignal, "dump-on-signal", config.DumpOnSignal, "Log the resolved config and the routes on SIGUSR1 (not available on Windows)")
+	flag.BoolVar(&config.StatsRequireToken, "stats-require-token", config.StatsRequireToken, "Require the -admin-token for /debug/stats")
+	flag.StringVar(&config.Env, "env", config.Env, "Name of the environment the app is running in, production changes some defaults (see README)")
+	flag.IntVar(&config.DBLockRetries, "db-lock-retries", config.DBLockRetries, "Number of times a write is retried when the database is locked")
+	flag.DurationVar(&config.DBLockRetryBackoff, "db-lock-backoff", config.DBLockRetryBackoff, "Wait before the first retry of a locked write, doubled on every further retry")
+	flag.IntVar(&config.MigrationRetries, "migration-retries", config.MigrationRetries, "Number of times the pending migrations are run again after a transient database error, e.g. a busy database")
+	flag.DurationVar(&config.MigrationRetryBackoff, "migration-retry-backoff", config.MigrationRetryBackoff, "Wait before the first migration retry, doubled on every further retry")
+	flag.BoolVar(&config.KeepAlives, "keep-alives", config.KeepAlives, "Keep client connections open between requests")
+	flag.DurationVar(&config.KeepAlivePeriod, "keep-alive-period", config.KeepAlivePeriod, "Interval between TCP keep-alive probes")
+	flag.DurationVar(&config.ShutdownGrace, "shutdown-grace", config.ShutdownGrace, "How long open connections get to finish on shutdown before they are closed")
+	flag.BoolVar(&config.ReusePort, "reuse-port", config.ReusePort, "Set SO_REUSEPORT on the listener so several processes can bind the same port")
+	flag.IntVar(&config.MaxConnsPerIP, "max-conns-per-ip", config.MaxConnsPerIP, "Most connections one client IP can have open, new ones are closed right away (0 turns the limit off)")
+	flag.Var((*fileModeValue)(&config.DataDirMode), "data-dir-mode", "Permissions (octal) of the data directory when it is created")
+	flag.StringVar(&config.JournalMode, "db-journal-mode", config.JournalMode, "sqlite journal mode (DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF), empty keeps the sqlite default")
+	flag.BoolVar(&config.ForeignKeys, "db-foreign-keys", config.ForeignKeys, "Enforce foreign key constraints in sqlite")
+	flag.DurationVar(&config.BusyTimeout, "db-busy-timeout", config.BusyTimeout, "How long sqlite waits for a lock before returning \"database is locked\"")
+	flag.DurationVar(&config.StartupTimeout, "startup-timeout", config.StartupTimeout, "How long startup waits for the database to answer before giving up")
+	flag.DurationVar(&config.SlowQuery, "slow-query", config.SlowQuery, "Log queries that take longer than this as slow (0 turns it off)")
+	flag.IntVar(&config.StatementCacheSize, "statement-cache-size", config.StatementCacheSize, "Most prepared statements kept for reuse, the least recently used one is closed first (0 turns the cache off)")
+	flag.DurationVar(&config.FlagCacheTTL, "flag-cache-ttl", config.FlagCacheTTL, "How long a feature flag is cached before it is read from the database again")
+	flag.IntVar(&config.EventBuffer, "event-buffer", config.EventBuffer, "How many events a subscriber can fall behind before new ones are dropped for it")
+	flag.DurationVar(&config.EventDrainTimeout, "event-drain-timeout", config.EventDrainTimeout, "How long shutdown waits for queued webhook deliveries before the rest are dropped")
+	flag.Var((*stringListValue)(&config.WebhookURLs), "webhook-urls", "Comma separated URLs that receive a POST for every event")
+	flag.Var((*stringListValue)(&config.WebhookTopics), "webhook-topics", "Comma separated event topics sent to the webhooks (default all topics)")
+	flag.IntVar(&config.WebhookWorkers, "webhook-workers", config.WebhookWorkers, "Number of webhook deliveries made at the same time")
+	flag.DurationVar(&config.WebhookTimeout, "webhook-timeout", config.WebhookTimeout, "Timeout of a single webhook delivery attempt")
+	flag.IntVar(&config.WebhookRetries, "webhook-retries", config.WebhookRetries, "Number of times a failed webhook delivery is retried")
+	flag.DurationVar(&config.WebhookBackoff, "webhook-backoff", config.WebhookBackoff, "Wait before the first webhook retry, doubled on every further retry")
+	flag.IntVar(&config.WebhookBreakerFailures, "webhook-breaker-failures", config.WebhookBreakerFailures, "Consecutive failed attempts that stop deliveries to a webhook URL for the cooldown (0 turns the breaker off)")
+	flag.DurationVar(&config.WebhookBreakerCooldown, "webhook-breaker-cooldown", config.WebhookBreakerCooldown, "How long deliveries to a failing webhook URL are stopped before a trial delivery")
+	flag.BoolVar(&config.WebhookBreakerQueue, "webhook-breaker-queue", config.WebhookBreakerQueue, "Hold deliveries back while a webhook URL's breaker is open instead of dropping them")
+	flag.StringVar(&config.StaticDir, "static-dir", config.StaticDir, "Serve the ui files from this directory instead of the embedded copy (for frontend development)")
+	flag.StringVar(&config.SQLDir, "sql-dir", config.SQLDir, "Read the migration scripts from this directory instead of the embedded copy")
+	flag.Var((*stringListValue)(&config.AuditSinks), "audit-sinks", "Comma separated places admin actions are recorded: log, db (the audit_log table)")
+	flag.StringVar(&config.AdminAddr, "admin-addr", config.AdminAddr, "Serve the /admin and debug endpoints on this address instead of the main port")
+	flag.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "Bearer token for the /admin endpoints, which are disabled while it is empty")
+	flag.Var((*stringListValue)(&config.CorsOverrides), "cors-overrides", "Comma separated path=policy pairs choosing the CORS policy (public, api or none) for a path prefix, e.g. /admin=none")
+	flag.Var((*stringListValue)(&config.AllowedHosts), "allow-hosts", "Comma separated hosts the server answers, e.g. example.com,*.example.com, other Host headers get a 400 (default any host)")
+	flag.Var((*stringListValue)(&config.DisabledMethods), "disable-methods", "Comma separated HTTP methods answered with a 405 on every path, e.g. POST,PUT,PATCH,DELETE for a read-only instance")
+	flag.Var((*stringListValue)(&config.MethodExemptPaths), "disable-methods-exempt", "Comma separated path prefixes -disable-methods doesn't apply to")
+	flag.Var((*stringListValue)(&config.AllowedPaths), "allow-paths", "Comma separated path prefixes the server answers, all other paths get a 404 (default all paths)")
+	flag.Var((*stringListValue)(&config.Locales), "locales", "Comma separated locales responses can be localized to, the first one is used when none fits Accept-Language")
+	flag.Var((*stringListValue)(&config.PageSizes), "page-sizes", "Comma separated resource=default:max page sizes of list endpoints, e.g. flags=20:100 (default flags=100:500)")
+	flag.StringVar(&config.SessionCookie, "session-cookie", config.SessionCookie, "Name of the session cookie")
+	flag.BoolVar(&config.SecureCookies, "secure-cookies", config.SecureCookies, "Always mark cookies Secure, not only on https requests (direct or X-Forwarded-Proto from a trusted proxy)")
+	flag.DurationVar(&config.SessionTTL, "session-ttl", config.SessionTTL, "How long a session lasts after it was last saved")
+	flag.BoolVar(&config.DefaultCharset, "default-charset", config.DefaultCharset, "Add \"; charset=utf-8\" to text and JSON content types without a charset")
+	flag.BoolVar(&config.ResponseEnvelope, "envelope", config.ResponseEnvelope, "Wrap JSON responses in {\"data\": ..., \"error\": ...}")
+	flag.DurationVar(&config.CacheTTL, "cache-ttl", config.CacheTTL, "How long responses of /buildinfo are cached (0 turns the cache off)")
+	flag.IntVar(&config.CacheEntries, "cache-entries", config.CacheEntries, "Most responses kept in the cache, the least recently used one is dropped first")
+	flag.Var((*stringListValue)(&config.APIVersions), "api-versions", "Comma separated X-API-Version values the API accepts, the header is required when this is set (default not required)")
+	flag.Var((*stringListValue)(&config.ContentTypes), "content-types", "Comma separated media types accepted in API request bodies, other ones get a 415")
+	flag.IntVar(&config.RateLimit, "rate-limit", config.RateLimit, "Most requests a client IP can make per -rate-limit-window, further ones get a 429 (0 turns the limit off)")
+	flag.DurationVar(&config.RateLimitWindow, "rate-limit-window", config.RateLimitWindow, "Length of the fixed windows -rate-limit counts requests in")
+	flag.StringVar(&config.RateLimitStore, "rate-limit-store", config.RateLimitStore, "Where request counts are kept: memory, or sqlite to share them between processes using the same database")
+	flag.IntVar(&config.MaxConcurrent, "max-concurrent", config.MaxConcurrent, "Most requests handled at the same time, further ones wait for -max-queue-wait (0 turns the limit off)")
+	flag.DurationVar(&config.MaxQueueWait, "max-queue-wait", config.MaxQueueWait, "How long a request waits for a -max-concurrent slot before it gets a 503")
+	flag.Int64Var(&config.MaxBodySize, "max-body-size", config.MaxBodySize, "Largest request body in bytes, larger ones get a 413")
+	flag.IntVar(&config.MaxJSONDepth, "max-json-depth", config.MaxJSONDepth, "Deepest nesting of objects and arrays in a JSON request body, deeper ones get a 400 (0 turns the check off)")
+	flag.IntVar(&config.MaxJSONTokens, "max-json-tokens", config.MaxJSONTokens, "Most tokens (values, keys and brackets) in a JSON request body, more get a 400 (0 turns the check off)")
+	flag.IntVar(&config.MaxPathSegments, "max-path-segments", config.MaxPathSegments, "Most segments a path can have, deeper ones get a 400 (0 turns the check off)")
+	flag.IntVar(&config.MaxURLLength, "max-url-length", config.MaxURLLength, "Longest URL accepted, longer ones get a 414 (0 turns the check off)")
+	flag.IntVar(&config.CompressionLevel, "compression-level", config.CompressionLevel, "gzip level for responses, 1 (fastest) to 9 (smallest), -1 for the default or 0 to turn compression off")
+	flag.Var((*stringListValue)(&config.TrustedProxies), "trusted-proxies", "Comma separated IP addresses or CIDR ranges of reverse proxies whose X-Forwarded-* headers are believed")
+	flag.BoolVar(&config.HTTPSRedirect, "https-redirect", config.HTTPSRedirect, "Redirect requests a trusted proxy received over http (X-Forwarded-Proto) to https")
+	flag.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "PEM certificate file, serves https together with -tls-key")
+	flag.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "PEM private key file for -tls-cert")
+	flag.Var((*stringListValue)(&config.ACMEDomains), "acme-domains", "Comma separated domains to get certificates for from an ACME CA (Let's Encrypt), instead of -tls-cert and -tls-key")
+	flag.StringVar(&config.ACMEEmail, "acme-email", config.ACMEEmail, "Contact email for the ACME account")
+	flag.StringVar(&config.ACMEDirectory, "acme-directory", config.ACMEDirectory, "ACME directory URL, e.g. Let's Encrypt staging (default Let's Encrypt production)")
+	flag.StringVar(&config.ACMECacheDir, "acme-cache-dir", config.ACMECacheDir, "Directory the ACME account key and certificates are kept in (default acme/ in the data directory)")
+	flag.StringVar(&config.ACMEAddr, "acme-addr", config.ACMEAddr, "Address the server listens on for https with -acme-domains")
+	flag.StringVar(&config.ACMEHTTPAddr, "acme-http-addr", config.ACMEHTTPAddr, "Address that answers ACME HTTP-01 challenges and redirects everything else to https")
+	flag.Var((*stringListValue)(&config.TLSCipherSuites), "tls-ciphers", "Comma separated TLS 1.2 cipher suites to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default Go's secure suites)")
+	flag.Var((*stringListValue)(&config.TLSCurves), "tls-curves", "Comma separated key exchange curves in order of preference: X25519, P256, P384, P521 (default Go's order)")
+	flag.DurationVar(&config.HSTSMaxAge, "hsts-max-age", config.HSTSMaxAge, "max-age of the Strict-Transport-Security header on https responses (0 leaves the header out)")
+	flag.BoolVar(&config.HSTSIncludeSubDomains, "hsts-include-subdomains", config.HSTSIncludeSubDomains, "Add includeSubDomains to the Strict-Transport-Security header")
+	flag.Parse()
+}
+
+// envDefaults are the flags whose default depends on -env, by flag name. A flag given on the command line keeps its
+// value.
+var envDefaults = map[string]map[string]string{
+	"production": {
+		"secure-cookies":      "true",
+		"pprof-require-token": "true",
+		"stats-require-token": "true",
+	},
+}
+
+// applyEnvDefaults sets the envDefaults of env on the flags of fs that weren't given.
+func applyEnvDefaults(fs *flag.FlagSet, env string) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range envDefaults[env] {
+		if given[name] {
+			continue
+		}
+		err := fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("could not apply the %s default of -%s: %w", env, name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateConfig checks the settings that can be out of range and parses the ones that need it. The -env defaults
+// are applied first, so the checks see them.
+func validateConfig() error {
+	err := applyEnvDefaults(flag.CommandLine, config.Env)
+	if err != nil {
+		return err
+	}
+
+	if config.LogSampleRate < 1 {
+		return fmt.Errorf("log sample rate must be at least 1")
+	}
+	if config.SessionTTL <= 0 {
+		return fmt.Errorf("session ttl must be positive")
+	}
+
+	err = validateCompressionLevel(config.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	trustedProxyNets, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	err = parsePageSizes(config.PageSizes)
+	if err != nil {
+		return err
+	}
+
+	if config.RateLimitWindow < time.Second {
+		return fmt.Errorf("rate limit window must be at least 1s")
+	}
+	err = validateRateLimitStore(config.RateLimitStore)
+	if err != nil {
+		return err
+	}
+
+	err = validateAuditSinks(config.AuditSinks)
+	if err != nil {
+		return err
+	}
+
+	err = validateACMEConfig(config)
+	if err != nil {
+		return err
+	}
+	if len(config.ACMEDomains) > 0 {
+		acmeManager, err = newACMEManager(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	tlsConfig, err = buildTLSConfig(config)
+	if err != nil {
+		return err
+	}
+
+	corsOverrides, err = parseCorsOverrides(config.CorsOverrides)
+	return err
+}
+
+type configContextKey struct{}
+
+// configMiddleware makes the resolved config available to handlers through configFromContext.
+func configMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), configContextKey{}, &config)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// configFromContext returns the config stored by configMiddleware, or the package level config when there is none.
+func configFromContext(ctx context.Context) *Config {
+	c, ok := ctx.Value(configContextKey{}).(*Config)
+	if !ok {
+		return &config
+	}
+
+	return c
+}
+
+// redacted replaces secrets in the /config response.
+const redacted = "REDACTED"
+
+type DatabaseConfig struct {
+	Driver     string
+	DataSource string
+}
+
+// ResolvedConfig is the /config response.
+type ResolvedConfig struct {
+	Config   Config
+	Database DatabaseConfig
+}
+
+// configHandler returns the config after flag parsing, with tokens, the TLS key path and any passwords redacted.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, resolveConfig(configFromContext(r.Context())))
+}
+
+// resolveConfig returns the config with the secrets in it redacted.
+func resolveConfig(c *Config) ResolvedConfig {
+	resolved := *c
+	if resolved.AdminToken != "" {
+		resolved.AdminToken = redacted
+	}
+	if resolved.TLSKey != "" {
+		resolved.TLSKey = redacted
+	}
+	resolved.WebhookURLs = make([]string, len(c.WebhookURLs))
+	for i, webhookURL := range c.WebhookURLs {
+		resolved.WebhookURLs[i] = redactURL(webhookURL)
+	}
+
+	return ResolvedConfig{
+		Config:   resolved,
+		Database: DatabaseConfig{Driver: dbDriver, DataSource: redactURL(dbDataSource)},
+	}
+}
+
+// redactURL hides the password in the user info and in query parameters like _auth_pass, which the sqlite driver
+// reads from the data source name.
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return redacted
+	}
+
+	changed := false
+	if _, ok := parsed.User.Password(); ok {
+		parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+		changed = true
+	}
+
+	query := parsed.Query()
+	for name := range query {
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "pass") || strings.Contains(lower, "token") || strings.Contains(lower, "secret") {
+			query.Set(name, redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return value
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
+
+// stringListValue lets a list be passed as a comma separated flag value, e.g. -allow-paths /helloworld,/hellovars
+type stringListValue []string
+
+func (l *stringListValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringListValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
+
+// fileModeValue lets a file mode be passed as an octal flag value, e.g. -data-dir-mode 0700
+type fileModeValue os.FileMode
+
+func (m *fileModeValue) String() string {
+	return "0" + strconv.FormatUint(uint64(*m), 8)
+}
+
+func (m *fileModeValue) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return err
+	}
+
+	*m = fileModeValue(os.FileMode(mode) & os.ModePerm)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withConfig replaces the package level config for the test.
+func withConfig(t *testing.T, c Config) {
+	t.Helper()
+
+	previous := config
+	config = c
+	t.Cleanup(func() { config = previous })
+}
+
+func TestHandlerReadsEnvFromContext(t *testing.T) {
+	c := config
+	c.Env = "staging"
+	withConfig(t, c)
+
+	var env string
+	handler := configMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env = configFromContext(r.Context()).Env
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if env != "staging" {
+		t.Fatalf("got env %q, want staging", env)
+	}
+}
+
+func TestApplyEnvDefaults(t *testing.T) {
+	newFlags := func(args ...string) (*flag.FlagSet, *Config) {
+		c := &Config{}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.BoolVar(&c.SecureCookies, "secure-cookies", false, "")
+		fs.BoolVar(&c.PprofRequireToken, "pprof-require-token", false, "")
+		fs.BoolVar(&c.StatsRequireToken, "stats-require-token", false, "")
+		err := fs.Parse(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs, c
+	}
+
+	fs, c := newFlags()
+	err := applyEnvDefaults(fs, "development")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SecureCookies || c.PprofRequireToken || c.StatsRequireToken {
+		t.Fatalf("development changed the defaults: %+v", c)
+	}
+
+	fs, c = newFlags("-pprof-require-token=false")
+	err = applyEnvDefaults(fs, "production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.SecureCookies || !c.StatsRequireToken {
+		t.Fatal("production didn't change the defaults")
+	}
+	if c.PprofRequireToken {
+		t.Fatal("production overrode a flag given on the command line")
+	}
+}
+
+func TestConfigEndpointRedactsSecrets(t *testing.T) {
+	withAdminConfig(t)
+	config.TLSKey = "/etc/app/key.pem"
+	previous := dbDataSource
+	dbDataSource = "file:/data/app.db?_auth&_auth_user=admin&_auth_pass=hunter2"
+	t.Cleanup(func() { dbDataSource = previous })
+
+	w := serve(newRoutes().handler, adminRequest(http.MethodGet, "/config"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+
+	var resolved ResolvedConfig
+	err := json.Unmarshal(w.Body.Bytes(), &resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Database.Driver != dbDriver {
+		t.Errorf("got driver %q, want %q", resolved.Database.Driver, dbDriver)
+	}
+	for _, secret := range []string{"hunter2", testAdminToken, "key.pem"} {
+		if strings.Contains(w.Body.String(), secret) {
+			t.Errorf("/config shows %q: %s", secret, w.Body.String())
+		}
+	}
+	if !strings.Contains(resolved.Database.DataSource, "_auth_user=admin") {
+		t.Errorf("got data source %q, want only the password redacted", resolved.Database.DataSource)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"net"
+	"sync"
+)
+
+// *********************************************************
+// Connection limit per client IP
+// *********************************************************
+
+// connLimitListener closes new connections from an IP that already has max connections open.
+type connLimitListener struct {
+	net.Listener
+	max    int
+	mutex  sync.Mutex
+	active map[string]int
+}
+
+// limitConnsPerIP wraps the listener, max 0 turns the limit off.
+func limitConnsPerIP(listener net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return listener
+	}
+
+	return &connLimitListener{Listener: listener, max: max, active: make(map[string]int)}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn)
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+
+		log.Warn().Str("ip", ip).Int("limit", l.max).Msg("Refused connection, too many open connections from this IP")
+		conn.Close()
+	}
+}
+
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.active[ip]--
+	if l.active[ip] <= 0 {
+		// Don't keep an entry for every IP that ever connected
+		delete(l.active, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// limitedConn gives its slot back the first time it is closed. net/http may close a connection more than once.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
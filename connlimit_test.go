@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimitPerIP(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := limitConnsPerIP(inner, 2)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	accept := func() net.Conn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(time.Second):
+			t.Fatal("connection wasn't accepted")
+			return nil
+		}
+	}
+
+	dial()
+	first := accept()
+	dial()
+	accept()
+
+	// The third connection from the same IP is closed by the server
+	refused := dial()
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = refused.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("got %v reading from the connection over the limit, want EOF", err)
+	}
+
+	// Closing one frees its slot
+	first.Close()
+	dial()
+	accept()
+}
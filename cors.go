@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// *********************************************************
+// CORS
+// *********************************************************
+
+// CorsPolicy describes the CORS headers sent for a group of routes.
+type CorsPolicy struct {
+	// AllowedOrigins are echoed back in Access-Control-Allow-Origin. A "*" entry allows every origin.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+}
+
+// publicCorsPolicy is used for the index page and static assets, which anyone may load.
+var publicCorsPolicy = CorsPolicy{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{http.MethodGet, http.MethodOptions},
+	AllowedHeaders: []string{"Accept", "Content-Type", "Content-Length"},
+}
+
+// apiCorsPolicy is used for the route handlers and only allows the origins the app itself is served from.
+var apiCorsPolicy = CorsPolicy{
+	AllowedOrigins: []string{"http://127.0.0.1:8081", "http://localhost:8081"},
+	AllowedMethods: []string{http.MethodPost, http.MethodGet, http.MethodOptions, http.MethodPut, http.MethodDelete},
+	AllowedHeaders: []string{"Accept", "Content-Type", "Content-Length", "Authorization"},
+}
+
+// corsPolicies are the policies -cors-overrides can refer to by name. "none" sends no CORS headers, so browsers only
+// allow same origin requests.
+var corsPolicies = map[string]CorsPolicy{
+	"public": publicCorsPolicy,
+	"api":    apiCorsPolicy,
+	"none":   {},
+}
+
+type corsOverride struct {
+	prefix string
+	policy CorsPolicy
+}
+
+// corsOverrides is parsed from -cors-overrides by validateConfig, longest prefix first.
+var corsOverrides []corsOverride
+
+// parseCorsOverrides reads "prefix=policy" values, e.g. "/admin=none"
+func parseCorsOverrides(values []string) ([]corsOverride, error) {
+	overrides := make([]corsOverride, 0, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("CORS override %q must look like /path=policy", value)
+		}
+
+		policy, ok := corsPolicies[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("CORS override %q uses an unknown policy, use public, api or none", value)
+		}
+		overrides = append(overrides, corsOverride{prefix: parts[0], policy: policy})
+	}
+
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return len(overrides[i].prefix) > len(overrides[j].prefix)
+	})
+
+	return overrides, nil
+}
+
+// corsMiddleware sets the headers of the given policy, unless a -cors-overrides prefix matches the path. Attach it to
+// a subrouter with Use().
+func corsMiddleware(policy CorsPolicy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			corsPolicyFor(r.URL.Path, policy).apply(w, r)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// corsPolicyFor returns the policy of the most specific override matching the path, or the fallback.
+func corsPolicyFor(path string, fallback CorsPolicy) CorsPolicy {
+	for _, override := range corsOverrides {
+		if hasPathPrefix(path, []string{override.prefix}) {
+			return override.policy
+		}
+	}
+
+	return fallback
+}
+
+func (p CorsPolicy) apply(w http.ResponseWriter, r *http.Request) {
+	origin := p.allowedOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if origin != "*" {
+		// The response differs per origin, so caches must not share it between origins.
+		w.Header().Add("Vary", "Origin")
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+}
+
+// allowedOrigin returns the value for Access-Control-Allow-Origin, or "" when the origin is not allowed.
+func (p CorsPolicy) allowedOrigin(origin string) string {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
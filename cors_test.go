@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func corsOrigin(t *testing.T, handler http.Handler, path, origin string) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("Origin", origin)
+	return serve(handler, r).Header().Get("Access-Control-Allow-Origin")
+}
+
+func TestCorsPerRouteGroup(t *testing.T) {
+	handler := newRoutes().handler
+
+	if got := corsOrigin(t, handler, "/ui/css/app.css", "http://elsewhere.example"); got != "*" {
+		t.Errorf("static asset got Access-Control-Allow-Origin %q, want *", got)
+	}
+	if got := corsOrigin(t, handler, "/uptime", "http://localhost:8081"); got != "http://localhost:8081" {
+		t.Errorf("API route got Access-Control-Allow-Origin %q for an allowed origin, want it echoed", got)
+	}
+	if got := corsOrigin(t, handler, "/uptime", "http://elsewhere.example"); got != "" {
+		t.Errorf("API route got Access-Control-Allow-Origin %q for another origin, want none", got)
+	}
+}
+
+func TestCorsOverrides(t *testing.T) {
+	withAdminConfig(t)
+	openTestDB(t)
+	overrides, err := parseCorsOverrides([]string{"/admin=none", "/helloworld=public"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := corsOverrides
+	corsOverrides = overrides
+	t.Cleanup(func() { corsOverrides = previous })
+
+	handler := newRoutes().handler
+	if got := corsOrigin(t, handler, "/admin/flags", "http://localhost:8081"); got != "" {
+		t.Errorf("/admin got Access-Control-Allow-Origin %q, want none", got)
+	}
+	if got := corsOrigin(t, handler, "/helloworld", "http://elsewhere.example"); got != "*" {
+		t.Errorf("/helloworld got Access-Control-Allow-Origin %q, want *", got)
+	}
+	if got := corsOrigin(t, handler, "/uptime", "http://elsewhere.example"); got != "" {
+		t.Errorf("/uptime got Access-Control-Allow-Origin %q, want the api policy", got)
+	}
+
+	_, err = parseCorsOverrides([]string{"/admin=open"})
+	if err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
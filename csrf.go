@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/rs/zerolog/log"
+	"mime"
+	"net/http"
+)
+
+// *********************************************************
+// CSRF protection
+// *********************************************************
+
+const (
+	csrfCookie    = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+type csrfContextKey struct{}
+
+// csrfMiddleware protects cookie authenticated routes with double-submit cookies: every client gets a random token
+// in the csrf_token cookie, and POST, PUT, PATCH and DELETE requests have to send it back in the X-CSRF-Token header
+// or the csrf_token form field. Another site can make the browser send the cookie, but it can't read it, so it can't
+// send the matching value. Requests without a match get a 403.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookie); err == nil {
+			token = cookie.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			if token == "" {
+				var err error
+				token, err = randomToken()
+				if err != nil {
+					log.Error().Err(err).Msg("Could not create a CSRF token")
+					writeError(w, http.StatusInternalServerError, "could not create a CSRF token")
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookie,
+					Value:    token,
+					Path:     "/",
+					Secure:   secureCookies(r),
+					SameSite: http.SameSiteLaxMode,
+					// Not HttpOnly, scripts have to read it to send the header
+				})
+			}
+		default:
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submittedCSRFToken(r))) != 1 {
+				log.Warn().Str("method", r.Method).Str("path", r.URL.Path).Msg("Rejected request with a missing or wrong CSRF token")
+				writeError(w, http.StatusForbidden, "missing or invalid CSRF token")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token)))
+	})
+}
+
+// submittedCSRFToken reads the token from the header, or from the form field for form posts.
+func submittedCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		return r.PostFormValue(csrfFormField)
+	}
+
+	return ""
+}
+
+// csrfTokenFromContext returns the token forms rendered for this request have to include in a csrf_token field.
+func csrfTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(csrfContextKey{}).(string)
+	return token
+}
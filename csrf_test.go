@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	handler := csrfMiddleware(http.HandlerFunc(pingHandler))
+
+	w := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != csrfCookie || cookies[0].Value == "" {
+		t.Fatalf("GET got %d with cookies %v, want 200 and a token cookie", w.Code, cookies)
+	}
+	token := cookies[0]
+
+	post := func(cookie *http.Cookie, header string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if header != "" {
+			r.Header.Set(csrfHeader, header)
+		}
+		return serve(handler, r).Code
+	}
+	if status := post(token, token.Value); status != http.StatusOK {
+		t.Errorf("matching token got %d, want 200", status)
+	}
+	if status := post(token, ""); status != http.StatusForbidden {
+		t.Errorf("missing header got %d, want 403", status)
+	}
+	if status := post(token, token.Value+"x"); status != http.StatusForbidden {
+		t.Errorf("mismatched token got %d, want 403", status)
+	}
+	if status := post(nil, token.Value); status != http.StatusForbidden {
+		t.Errorf("missing cookie got %d, want 403", status)
+	}
+
+	// Forms send the token in a field
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(csrfFormField+"="+token.Value))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(token)
+	if status := serve(handler, r).Code; status != http.StatusOK {
+		t.Errorf("form field got %d, want 200", status)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// *********************************************************
+// Timestamps in the database
+// *********************************************************
+
+// dbTimeLayout is RFC 3339 in UTC with a fixed nine digit fraction, so stored timestamps sort as text in time order.
+// sqlite has no time type and the driver hands text columns back as strings.
+const dbTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// formatDBTime is how timestamps are written to text columns, e.g. audit_log.time.
+func formatDBTime(t time.Time) string {
+	return t.UTC().Format(dbTimeLayout)
+}
+
+// parseDBTime reads a timestamp written by formatDBTime, or any other RFC 3339 one, as UTC.
+func parseDBTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q in the database: %w", value, err)
+	}
+
+	return t.UTC(), nil
+}
+
+// DBTime scans and stores a timestamp column with formatDBTime and parseDBTime, so it can be used with Scan and as a
+// query argument directly.
+type DBTime struct {
+	time.Time
+}
+
+func (t *DBTime) Scan(value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case string:
+		t.Time, err = parseDBTime(v)
+	case []byte:
+		t.Time, err = parseDBTime(string(v))
+	case time.Time:
+		// Columns declared as datetime or timestamp are parsed by the driver already
+		t.Time = v.UTC()
+	default:
+		err = fmt.Errorf("can't scan %T into a timestamp", value)
+	}
+
+	return err
+}
+
+func (t DBTime) Value() (driver.Value, error) {
+	return formatDBTime(t.Time), nil
+}
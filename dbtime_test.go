@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDBTimeRoundTrip(t *testing.T) {
+	db := openTestDB(t)
+
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	earlier := time.Date(2026, 3, 1, 23, 30, 0, 5, zone)
+	later := earlier.Add(time.Millisecond)
+	for _, value := range []time.Time{later, earlier} {
+		_, err := db.Exec("insert into audit_log(time, actor, action, target, result, request_id) values(?, 'test', 'flag.set', 'new-greeting', 'ok', '')", DBTime{value})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := db.Query("select time from audit_log order by time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []DBTime
+	for rows.Next() {
+		var value DBTime
+		err = rows.Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, value)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || !got[0].Equal(earlier) || !got[1].Equal(later) {
+		t.Fatalf("got %v, want %v and %v in that order", got, earlier, later)
+	}
+	if got[0].Location() != time.UTC {
+		t.Fatalf("got location %s, want UTC", got[0].Location())
+	}
+
+	var text string
+	err = db.QueryRow("select time from audit_log order by time limit 1").Scan(&text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "2026-03-01T21:30:00.000000005Z" {
+		t.Fatalf("got stored text %q", text)
+	}
+}
+
+func TestDBTimeScanRejectsInvalidText(t *testing.T) {
+	var value DBTime
+	if err := value.Scan("yesterday"); err == nil {
+		t.Fatal("expected an error for an invalid timestamp")
+	}
+	if err := value.Scan(42); err == nil {
+		t.Fatal("expected an error for an integer")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Debug endpoints (only registered with -debug)
+// *********************************************************
+
+// recentRequests holds the last requests for /debug/requests. It is nil unless -debug is set.
+var recentRequests *requestLog
+
+type RequestLogEntry struct {
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration string    `json:"duration"`
+	Time     time.Time `json:"time"`
+}
+
+// requestLog is a fixed size ring buffer of request log entries. Once it is full the oldest entry is overwritten.
+type requestLog struct {
+	mutex   sync.Mutex
+	entries []RequestLogEntry
+	next    int
+	full    bool
+}
+
+func newRequestLog(size int) *requestLog {
+	if size < 1 {
+		size = 1
+	}
+
+	return &requestLog{entries: make([]RequestLogEntry, size)}
+}
+
+func (l *requestLog) add(entry RequestLogEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the entries oldest first.
+func (l *requestLog) list() []RequestLogEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.full {
+		return append([]RequestLogEntry{}, l.entries[:l.next]...)
+	}
+
+	return append(append([]RequestLogEntry{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+// debugRequestsHandler returns the recent requests, oldest first. ?limit=n returns only the last n.
+func debugRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	entries := recentRequests.list()
+	limit := intParam(r, "limit", len(entries), 0, len(entries))
+
+	writeJSON(w, http.StatusOK, entries[len(entries)-limit:])
+}
+
+// RuntimeStats is the response of /debug/stats.
+type RuntimeStats struct {
+	Goroutines int `json:"goroutines"`
+	GOMAXPROCS int `json:"gomaxprocs"`
+	// Bytes of allocated heap objects
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"totalAlloc"`
+	Sys          uint64 `json:"sys"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	NumGC        uint32 `json:"numGC"`
+	PauseTotalNs uint64 `json:"pauseTotalNs"`
+}
+
+// debugStatsHandler returns the number of goroutines and the main memory stats, to spot leaks without a profile.
+func debugStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	writeJSON(w, http.StatusOK, RuntimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		Alloc:        memStats.Alloc,
+		TotalAlloc:   memStats.TotalAlloc,
+		Sys:          memStats.Sys,
+		HeapInuse:    memStats.HeapInuse,
+		HeapObjects:  memStats.HeapObjects,
+		NumGC:        memStats.NumGC,
+		PauseTotalNs: memStats.PauseTotalNs,
+	})
+}
+
+// pprofHandler serves the net/http/pprof profiles under /debug/pprof/
+func pprofHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			// The index page and the named profiles, e.g. /debug/pprof/heap
+			pprof.Index(w, r)
+		}
+	})
+}
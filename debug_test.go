@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestRequestLogKeepsTheLastRequestsInOrder(t *testing.T) {
+	previous := recentRequests
+	recentRequests = newRequestLog(3)
+	t.Cleanup(func() { recentRequests = previous })
+
+	handler := loggingMiddleware(http.HandlerFunc(pingHandler))
+	for i := 1; i <= 5; i++ {
+		serve(handler, httptest.NewRequest(http.MethodGet, "/request/"+strconv.Itoa(i), nil))
+	}
+
+	entries := recentRequests.list()
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	for i, entry := range entries {
+		want := "/request/" + strconv.Itoa(i+3)
+		if entry.Path != want || entry.Status != http.StatusOK {
+			t.Errorf("entry %d is %s %d, want %s 200", i, entry.Path, entry.Status, want)
+		}
+	}
+}
+
+func TestPprofOnlyWithDebug(t *testing.T) {
+	for _, debug := range []bool{true, false} {
+		c := config
+		c.AdminAddr = "127.0.0.1:0"
+		c.Debug = debug
+		withConfig(t, c)
+
+		want := http.StatusNotFound
+		if debug {
+			want = http.StatusOK
+		}
+		if got := serve(newRoutes().internalHandler, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)).Code; got != want {
+			t.Errorf("with -debug=%v /debug/pprof/ got %d, want %d", debug, got, want)
+		}
+	}
+}
+
+func TestDebugStats(t *testing.T) {
+	c := config
+	c.AdminAddr = "127.0.0.1:0"
+	c.Debug = true
+	withConfig(t, c)
+	runtime.GC()
+
+	w := serve(newRoutes().internalHandler, httptest.NewRequest(http.MethodGet, "/debug/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", w.Code)
+	}
+
+	var stats RuntimeStats
+	err := json.Unmarshal(w.Body.Bytes(), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Goroutines < 1 || stats.GOMAXPROCS < 1 {
+		t.Errorf("got %d goroutines and GOMAXPROCS %d", stats.Goroutines, stats.GOMAXPROCS)
+	}
+	if stats.Alloc == 0 || stats.HeapInuse == 0 || stats.Sys < stats.HeapInuse || stats.NumGC == 0 {
+		t.Errorf("got memory stats %+v", stats)
+	}
+}
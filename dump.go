@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// *********************************************************
+// State dump on SIGUSR1
+// *********************************************************
+
+// dumpOnSignal logs the state of the server every time the dump signal arrives, until stop is closed. Platforms
+// without SIGUSR1 never send one, see notifyDumpSignal.
+func dumpOnSignal(routers []*mux.Router, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	if !notifyDumpSignal(signals) {
+		return
+	}
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				dumpState(routers)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// dumpState logs the config, with the secrets redacted, and every registered route with its methods.
+func dumpState(routers []*mux.Router) {
+	resolved, err := json.Marshal(resolveConfig(&config))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not dump the config")
+	} else {
+		log.Info().RawJSON("config", resolved).Msg("Resolved config")
+	}
+
+	for _, router := range routers {
+		err = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+			template, err := route.GetPathTemplate()
+			if err != nil || route.GetHandler() == nil {
+				// Routes that only group others, e.g. the api and /admin subrouters
+				return nil
+			}
+			methods, err := route.GetMethods()
+			if err != nil {
+				methods = []string{"*"}
+			}
+
+			log.Info().Str("path", template).Str("methods", strings.Join(methods, ",")).Msg("Route")
+			return nil
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Could not dump the routes")
+		}
+	}
+}
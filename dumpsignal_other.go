@@ -0,0 +1,11 @@
+//go:build windows || plan9 || js
+// +build windows plan9 js
+
+package main
+
+import "os"
+
+// notifyDumpSignal does nothing, these platforms have no SIGUSR1.
+func notifyDumpSignal(signals chan<- os.Signal) bool {
+	return false
+}
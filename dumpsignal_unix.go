@@ -0,0 +1,16 @@
+//go:build !windows && !plan9 && !js
+// +build !windows,!plan9,!js
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDumpSignal relays SIGUSR1 to signals.
+func notifyDumpSignal(signals chan<- os.Signal) bool {
+	signal.Notify(signals, syscall.SIGUSR1)
+	return true
+}
@@ -0,0 +1,70 @@
+//go:build !windows && !plan9 && !js
+// +build !windows,!plan9,!js
+
+package main
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// lineWriter hands every log line to a channel, so lines logged by another goroutine can be waited for.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestDumpOnSignal(t *testing.T) {
+	withAdminConfig(t)
+	lines := make(lineWriter, 1000)
+	previous := log.Logger
+	log.Logger = zerolog.New(lines)
+	t.Cleanup(func() { log.Logger = previous })
+
+	routers := newRoutes().routers
+
+	// A dump made right away says how many lines to wait for
+	dumpState(routers)
+	want := len(lines)
+	for i := 0; i < want; i++ {
+		<-lines
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	dumpOnSignal(routers, stop)
+
+	err := syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dumped []string
+	timeout := time.After(5 * time.Second)
+	for len(dumped) < want {
+		select {
+		case line := <-lines:
+			dumped = append(dumped, line)
+		case <-timeout:
+			t.Fatalf("got %d of %d lines after SIGUSR1:\n%s", len(dumped), want, strings.Join(dumped, ""))
+		}
+	}
+
+	output := strings.Join(dumped, "")
+	if !strings.Contains(output, `"message":"Resolved config"`) {
+		t.Errorf("config not dumped:\n%s", output)
+	}
+	if !strings.Contains(output, `"path":"/hellovars/{var1}/{var2}"`) {
+		t.Errorf("routes not dumped:\n%s", output)
+	}
+	if strings.Contains(output, testAdminToken+`"`) {
+		t.Errorf("dump shows the admin token:\n%s", output)
+	}
+}
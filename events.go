@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Event bus
+// *********************************************************
+
+// allTopics can be passed to Subscribe to receive every event.
+const allTopics = "*"
+
+// events is the bus handlers publish to, it is created in server().
+var events *EventBus
+
+type Event struct {
+	Topic   string      `json:"topic"`
+	Payload interface{} `json:"payload"`
+	Time    time.Time   `json:"time"`
+}
+
+// EventBus is an in-process publish/subscribe hub, so handlers can kick off background work without knowing who does
+// it. Every subscriber gets its own buffered channel.
+type EventBus struct {
+	mutex       sync.RWMutex
+	subscribers map[string][]chan Event
+	bufferSize  int
+	closed      bool
+}
+
+func NewEventBus(bufferSize int) *EventBus {
+	return &EventBus{subscribers: map[string][]chan Event{}, bufferSize: bufferSize}
+}
+
+// Subscribe returns a channel receiving the events published on the topic, or on every topic for allTopics. The
+// channel is closed by Close once the events already in it have been read.
+func (b *EventBus) Subscribe(topic string) <-chan Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	channel := make(chan Event, b.bufferSize)
+	if b.closed {
+		close(channel)
+		return channel
+	}
+
+	b.subscribers[topic] = append(b.subscribers[topic], channel)
+	return channel
+}
+
+// Publish hands the event to every subscriber of the topic. It never blocks the caller: when a subscriber's buffer is
+// full the event is dropped for that subscriber and logged.
+func (b *EventBus) Publish(topic string, payload interface{}) {
+	event := Event{Topic: topic, Payload: payload, Time: time.Now()}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		log.Warn().Msg("Event bus is closed, dropping event " + topic)
+		return
+	}
+
+	for _, subscribers := range [][]chan Event{b.subscribers[topic], b.subscribers[allTopics]} {
+		for _, channel := range subscribers {
+			select {
+			case channel <- event:
+			default:
+				log.Warn().Msg("Event subscriber is not keeping up, dropping event " + topic)
+			}
+		}
+	}
+}
+
+// Close stops publishing and closes all subscriber channels. Subscribers still receive what was already queued.
+func (b *EventBus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for _, subscribers := range b.subscribers {
+		for _, channel := range subscribers {
+			close(channel)
+		}
+	}
+}
+
+// logEvents writes every event to the debug log until the bus is closed.
+func logEvents(subscription <-chan Event) {
+	for event := range subscription {
+		log.Debug().Str("topic", event.Topic).Interface("payload", event.Payload).Msg("Event published")
+	}
+}
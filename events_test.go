@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSubscriberReceivesPublishedEvent(t *testing.T) {
+	withAdminConfig(t)
+	openTestDB(t)
+	bus := withEventBus(t)
+	subscription := bus.Subscribe("flag.updated")
+
+	w := serve(newRoutes().handler, adminJSONRequest(http.MethodPut, "/admin/flags/new-greeting", `{"enabled":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+
+	select {
+	case event := <-subscription:
+		flag, ok := event.Payload.(FeatureFlag)
+		if event.Topic != "flag.updated" || !ok || flag.Name != "new-greeting" || !flag.Enabled {
+			t.Fatalf("got event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event published")
+	}
+}
+
+func TestCloseDrainsSubscribers(t *testing.T) {
+	bus := NewEventBus(2)
+	subscription := bus.Subscribe(allTopics)
+
+	bus.Publish("first", 1)
+	bus.Close()
+	bus.Publish("second", 2)
+
+	var topics []string
+	for event := range subscription {
+		topics = append(topics, event.Topic)
+	}
+	if len(topics) != 1 || topics[0] != "first" {
+		t.Fatalf("got events %v, want only first", topics)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Feature flags
+// *********************************************************
+
+type FeatureFlag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+type flagCacheEntry struct {
+	enabled bool
+	expires time.Time
+}
+
+// flagCache keeps flag lookups off the database for -flag-cache-ttl. Other processes sharing the database see a
+// change once their entry expires.
+var flagCache = struct {
+	sync.Mutex
+	entries map[string]flagCacheEntry
+}{entries: map[string]flagCacheEntry{}}
+
+// FlagEnabled reports whether the feature flag is turned on. Unknown flags, and flags that can't be read, are off.
+//
+//	if FlagEnabled(r.Context(), "new-greeting") { ... }
+func FlagEnabled(ctx context.Context, name string) bool {
+	flagCache.Lock()
+	entry, ok := flagCache.entries[name]
+	flagCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.enabled
+	}
+
+	var enabled bool
+	err := queryRowContext(ctx, "select enabled from feature_flags where name = ?", name).Scan(&enabled)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error().Err(err).Msg("Could not read feature flag " + name)
+		return false
+	}
+
+	flagCache.Lock()
+	flagCache.entries[name] = flagCacheEntry{enabled: enabled, expires: time.Now().Add(config.FlagCacheTTL)}
+	flagCache.Unlock()
+
+	return enabled
+}
+
+func setFlag(ctx context.Context, flag FeatureFlag) error {
+	err := withLockRetry(func() error {
+		_, err := execContext(ctx, "insert into feature_flags(name, enabled) values(?, ?) on conflict(name) do update set enabled = excluded.enabled", flag.Name, flag.Enabled)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	flagCache.Lock()
+	delete(flagCache.entries, flag.Name)
+	flagCache.Unlock()
+
+	return nil
+}
+
+// flagSortColumns are the fields GET /admin/flags can be sorted by.
+var flagSortColumns = map[string]string{"name": "name", "enabled": "enabled"}
+
+// listFlags returns a page of the flags in the given order, which has to come from sortParam.
+func listFlags(ctx context.Context, orderBy string, page Page) ([]FeatureFlag, error) {
+	rows, err := queryContext(ctx, "select name, enabled from feature_flags order by "+orderBy+" limit ? offset ?", page.Limit, page.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []FeatureFlag{}
+	for rows.Next() {
+		var flag FeatureFlag
+		err = rows.Scan(&flag.Name, &flag.Enabled)
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, flag)
+	}
+
+	return flags, rows.Err()
+}
+
+// countFlags returns how many flags have been set.
+func countFlags(ctx context.Context) (int, error) {
+	var count int
+	err := queryRowContext(ctx, "select count(*) from feature_flags").Scan(&count)
+	return count, err
+}
+
+// listFlagsHandler returns a page of the feature flags that have been set, by name unless ?sort= says otherwise.
+func listFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	orderBy, err := sortParam(r, flagSortColumns, "name asc")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := pageParam(r, "flags")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	flags, err := listFlags(r.Context(), orderBy, page)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		writeError(w, http.StatusInternalServerError, "could not read the feature flags")
+		return
+	}
+
+	total, err := countFlags(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		writeError(w, http.StatusInternalServerError, "could not read the feature flags")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newPageResponse(r, flags, page, total))
+}
+
+// setFlagHandler turns the flag in the path on or off, the body is {"enabled": true|false}
+func setFlagHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Enabled bool `json:"enabled"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+
+	flag := FeatureFlag{Name: mux.Vars(r)["name"], Enabled: body.Enabled}
+	err := setFlag(r.Context(), flag)
+	audit(r.Context(), "flag.set", flag.Name, auditResult(err))
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		writeError(w, http.StatusInternalServerError, "could not save the feature flag")
+		return
+	}
+
+	log.Info().Bool("enabled", flag.Enabled).Msg("Feature flag " + flag.Name + " changed")
+	events.Publish("flag.updated", flag)
+	writeJSON(w, http.StatusOK, flag)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFlagToggledThroughAdminEndpoint(t *testing.T) {
+	withAdminConfig(t)
+	config.FlagCacheTTL = 50 * time.Millisecond
+	openTestDB(t)
+	withEventBus(t)
+	ctx := context.Background()
+
+	if FlagEnabled(ctx, "new-greeting") {
+		t.Fatal("unknown flag is on")
+	}
+
+	w := serve(newRoutes().handler, adminJSONRequest(http.MethodPut, "/admin/flags/new-greeting", `{"enabled":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+	if !FlagEnabled(ctx, "new-greeting") {
+		t.Fatal("flag still off after the endpoint turned it on")
+	}
+
+	// A change made by another process only shows up once the cached entry expires
+	_, err := execContext(ctx, "update feature_flags set enabled = 0 where name = ?", "new-greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !FlagEnabled(ctx, "new-greeting") {
+		t.Fatal("flag read from the database before the cache expired")
+	}
+	time.Sleep(2 * config.FlagCacheTTL)
+	if FlagEnabled(ctx, "new-greeting") {
+		t.Fatal("flag still on after the cache expired")
+	}
+}
@@ -6,12 +6,15 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.9
+	github.com/rs/zerolog v1.26.1
 	github.com/spf13/afero v1.6.0
+	golang.org/x/crypto v0.6.0
+	golang.org/x/sys v0.5.0
 )
 
 require (
 	github.com/azer/is-terminal v1.0.0 // indirect
 	github.com/azer/logger v1.0.0 // indirect
-	github.com/rs/zerolog v1.26.1 // indirect
-	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/net v0.6.0 // indirect
+	golang.org/x/text v0.7.0 // indirect
 )
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"sync"
+)
+
+// *********************************************************
+// Shutdown hooks
+// *********************************************************
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var (
+	shutdownHooksMutex sync.Mutex
+	shutdownHooks      []shutdownHook
+)
+
+// onShutdown registers cleanup that runs after the servers have stopped. Hooks run in reverse order of registration,
+// so a component is cleaned up before the ones it was started on top of.
+func onShutdown(name string, fn func(ctx context.Context) error) {
+	shutdownHooksMutex.Lock()
+	defer shutdownHooksMutex.Unlock()
+
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// runShutdownHooks runs every registered hook once, last registered first. A failing hook is logged and doesn't stop
+// the ones after it. ctx carries the grace period the hooks share.
+func runShutdownHooks(ctx context.Context) {
+	shutdownHooksMutex.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownHooksMutex.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		err := hooks[i].fn(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Shutdown hook " + hooks[i].name + " failed")
+			continue
+		}
+		log.Debug().Msg("Shutdown hook " + hooks[i].name + " done")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestShutdownHooksRunLastRegisteredFirst(t *testing.T) {
+	var order []string
+	for _, name := range []string{"database", "webhooks", "failing", "cache"} {
+		name := name
+		onShutdown(name, func(ctx context.Context) error {
+			order = append(order, name)
+			if name == "failing" {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+
+	runShutdownHooks(context.Background())
+	if want := []string{"cache", "failing", "webhooks", "database"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("hooks ran in order %v, want %v", order, want)
+	}
+
+	// Every hook runs only once
+	runShutdownHooks(context.Background())
+	if len(order) != 4 {
+		t.Fatalf("hooks ran again: %v", order)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// *********************************************************
+// Concurrency limit
+// *********************************************************
+
+// concurrencyLimitMiddleware lets at most max requests be handled at the same time. A request that finds every slot
+// taken waits up to maxWait for one before it gets a 503. max 0 turns the limit off. Health checks are never limited,
+// so a busy server isn't taken for a dead one.
+func concurrencyLimitMiddleware(max int, maxWait time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+
+		slots := make(chan struct{}, max)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasPathPrefix(r.URL.Path, alwaysAllowedPaths) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !acquireSlot(r.Context(), slots, maxWait) {
+				log.Warn().Int("limit", max).Msg("Too many concurrent requests, rejected " + r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(maxWait)))
+				writeError(w, http.StatusServiceUnavailable, "the server is busy, try again later")
+				return
+			}
+			defer func() { <-slots }()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// acquireSlot takes a slot, waiting up to maxWait for one. It gives up early when the client goes away.
+func acquireSlot(ctx context.Context, slots chan struct{}, maxWait time.Duration) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if maxWait <= 0 {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryAfterSeconds rounds the wait up to whole seconds, at least 1.
+func retryAfterSeconds(wait time.Duration) int {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+
+	return seconds
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimitQueuesRequests(t *testing.T) {
+	for _, test := range []struct {
+		maxWait time.Duration
+		status  int
+	}{
+		{time.Second, http.StatusOK},
+		{20 * time.Millisecond, http.StatusServiceUnavailable},
+	} {
+		entered := make(chan struct{}, 2)
+		release := make(chan struct{})
+		handler := concurrencyLimitMiddleware(1, test.maxWait)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			<-release
+		}))
+
+		// The first request takes the only slot until it is released
+		done := make(chan struct{})
+		go func() {
+			serve(handler, httptest.NewRequest(http.MethodGet, "/helloworld", nil))
+			close(done)
+		}()
+		<-entered
+
+		time.AfterFunc(100*time.Millisecond, func() { close(release) })
+		w := serve(handler, httptest.NewRequest(http.MethodGet, "/helloworld", nil))
+		<-done
+
+		if w.Code != test.status {
+			t.Errorf("waiting up to %s got %d, want %d", test.maxWait, w.Code, test.status)
+		}
+		if test.status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Error("503 without Retry-After")
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// *********************************************************
+// Locales
+// *********************************************************
+
+type localeContextKey struct{}
+
+// localeMiddleware picks the supported locale that fits the Accept-Language header best and makes it available to
+// handlers through localeFromContext. The first supported locale is the fallback.
+func localeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := matchLocale(r.Header.Get("Accept-Language"), configFromContext(r.Context()).Locales)
+		ctx := context.WithValue(r.Context(), localeContextKey{}, locale)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// localeFromContext returns the locale chosen by localeMiddleware, or "en" when there is none.
+func localeFromContext(ctx context.Context) string {
+	locale, ok := ctx.Value(localeContextKey{}).(string)
+	if !ok {
+		return "en"
+	}
+
+	return locale
+}
+
+// matchLocale returns the supported locale the client prefers most. A language range matches a supported locale
+// exactly or by its primary language, so "fr-CA" picks "fr" and "fr" picks "fr-FR".
+func matchLocale(acceptLanguage string, supported []string) string {
+	if len(supported) == 0 {
+		return "en"
+	}
+
+	for _, wanted := range parseAcceptLanguage(acceptLanguage) {
+		if wanted == "*" {
+			return supported[0]
+		}
+		for _, locale := range supported {
+			if strings.EqualFold(wanted, locale) {
+				return locale
+			}
+		}
+		for _, locale := range supported {
+			if strings.EqualFold(primaryLanguage(wanted), primaryLanguage(locale)) {
+				return locale
+			}
+		}
+	}
+
+	return supported[0]
+}
+
+// parseAcceptLanguage returns the language ranges of the header, highest quality first. Ranges with q=0 are left out.
+func parseAcceptLanguage(header string) []string {
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+
+	var ranges []languageRange
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				value, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					quality = value
+				}
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, languageRange{tag: tag, quality: quality})
+		}
+	}
+
+	// Stable, so ranges with the same quality keep the client's order
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+
+	tags := make([]string, len(ranges))
+	for i, languageRange := range ranges {
+		tags[i] = languageRange.tag
+	}
+
+	return tags
+}
+
+func primaryLanguage(tag string) string {
+	return strings.SplitN(tag, "-", 2)[0]
+}
+
+//go:embed i18n/*.json
+var translationFiles embed.FS
+
+// fallbackLocale has every message, it is used for keys a locale doesn't translate.
+const fallbackLocale = "en"
+
+// translations maps locale to message key to text. It is loaded by startup() from i18n/<locale>.json.
+var translations map[string]map[string]string
+
+func loadTranslations(files fs.FS) (map[string]map[string]string, error) {
+	names, err := fs.Glob(files, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make(map[string]map[string]string, len(names))
+	for _, name := range names {
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+
+		messages := map[string]string{}
+		err = json.Unmarshal(data, &messages)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse translations %s: %w", name, err)
+		}
+		loaded[strings.TrimSuffix(name, path.Ext(name))] = messages
+	}
+
+	return loaded, nil
+}
+
+// translate returns the message in the locale, falling back to English and then to the key itself. Placeholders like
+// {name} are replaced by the values of args, which are name, value pairs.
+func translate(locale string, key string, args ...string) string {
+	message, ok := translations[locale][key]
+	if !ok {
+		message, ok = translations[fallbackLocale][key]
+	}
+	if !ok {
+		message = key
+	}
+
+	for i := 0; i+1 < len(args); i += 2 {
+		message = strings.ReplaceAll(message, "{"+args[i]+"}", args[i+1])
+	}
+
+	return message
+}
+
+// setLocaleHeaders tells clients and caches that the response depends on Accept-Language.
+func setLocaleHeaders(w http.ResponseWriter, locale string) {
+	w.Header().Set("Content-Language", locale)
+	w.Header().Add("Vary", "Accept-Language")
+}
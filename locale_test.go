@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// localeFor returns the locale localeMiddleware picks for the Accept-Language header.
+func localeFor(acceptLanguage string) string {
+	var locale string
+	handler := configMiddleware(localeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale = localeFromContext(r.Context())
+	})))
+
+	r := httptest.NewRequest(http.MethodGet, "/helloworld", nil)
+	r.Header.Set("Accept-Language", acceptLanguage)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	return locale
+}
+
+func TestLocaleFromAcceptLanguage(t *testing.T) {
+	c := config
+	c.Locales = []string{"en", "fr"}
+	withConfig(t, c)
+	if locale := localeFor("fr,en"); locale != "fr" {
+		t.Errorf("got %q with fr supported, want fr", locale)
+	}
+	if locale := localeFor("fr-CA;q=0.9, de"); locale != "fr" {
+		t.Errorf("got %q for fr-CA, want fr", locale)
+	}
+
+	config.Locales = []string{"en"}
+	if locale := localeFor("fr,en"); locale != "en" {
+		t.Errorf("got %q with only en supported, want en", locale)
+	}
+	if locale := localeFor(""); locale != "en" {
+		t.Errorf("got %q without Accept-Language, want en", locale)
+	}
+}
+
+func TestLocalizedGreeting(t *testing.T) {
+	c := config
+	c.Locales = []string{"en", "fr"}
+	withConfig(t, c)
+	openTestDB(t)
+	handler := newRoutes().handler
+
+	for acceptLanguage, greeting := range map[string]string{
+		"fr": "Bonjour Anna et Ben !",
+		"de": "Hello Anna and Ben!",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/hellovars/Anna/Ben", nil)
+		r.Header.Set("Accept-Language", acceptLanguage)
+		w := serve(handler, r)
+
+		var response HelloVars
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Greeting != greeting {
+			t.Errorf("Accept-Language %s got %q, want %q", acceptLanguage, response.Greeting, greeting)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/helloworld", nil)
+	r.Header.Set("Accept-Language", "fr")
+	if w := serve(handler, r); !strings.Contains(w.Body.String(), "Bonjour le monde !") {
+		t.Errorf("French page got %s", w.Body.String())
+	}
+}
+
+func TestTranslateFallsBackToEnglish(t *testing.T) {
+	previous := translations
+	translations = map[string]map[string]string{
+		"en": {"greeting": "Hello world!", "farewell": "Goodbye!"},
+		"fr": {"greeting": "Bonjour le monde !"},
+	}
+	t.Cleanup(func() { translations = previous })
+
+	if message := translate("fr", "farewell"); message != "Goodbye!" {
+		t.Errorf("missing French key got %q, want the English message", message)
+	}
+	if message := translate("fr", "unknown"); message != "unknown" {
+		t.Errorf("unknown key got %q, want the key", message)
+	}
+}
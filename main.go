@@ -1,17 +1,34 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/afero"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,172 +37,1318 @@ var sqlFiles embed.FS
 
 //go:embed ui/*
 var staticFiles embed.FS
-var db *sql.DB
+
+// dbHandle is the open database. Handlers get it from getDB(), so it can be replaced with swapDB() while requests
+// are running, e.g. to reconnect.
+var (
+	dbMutex  sync.RWMutex
+	dbHandle *sql.DB
+)
+
+func getDB() *sql.DB {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	return dbHandle
+}
+
+// swapDB makes next the database handlers use and returns the previous one. Closing it is up to the caller, requests
+// that already got it may still be using it.
+func swapDB(next *sql.DB) *sql.DB {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	previous := dbHandle
+	dbHandle = next
+	return previous
+}
+
+// dbDriver and dbDataSource are what the database was opened with, kept for /config.
+const dbDriver = "sqlite3"
+
+var dbDataSource string
+
+// AppFs is the file system the data directory and database file are created on.
+var AppFs = afero.NewOsFs()
 
 const appName = "helloworldapp"
 
-// init() is run by Golang the first time a program is run.
-func init() {
-	// UNIX Time is faster and smaller than most timestamps
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	// Default level for this example is info, unless debug flag is present
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	log.Info().Msg("Running init function")
-	startup()
+// init() is run by Golang the first time a program is run.
+func init() {
+	// UNIX Time is faster and smaller than most timestamps
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	// Default level for this example is info, unless debug flag is present
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	log.Info().Msg("Running init function")
+}
+
+// startup creates the data directory, opens the database and migrates it. Any error it returns leaves the app unable
+// to run.
+func startup() error {
+	dbFilePath, err := dataDir()
+	if err != nil {
+		return err
+	}
+
+	err = checkRequiredFiles(uiFiles(), requiredUIFiles)
+	if err != nil {
+		return fmt.Errorf("ui files are incomplete: %w", err)
+	}
+	err = checkRequiredFiles(migrationFiles(), requiredSQLFiles)
+	if err != nil {
+		return fmt.Errorf("sql files are incomplete: %w", err)
+	}
+
+	pageTemplates, err = loadTemplates(uiFiles())
+	if err != nil {
+		return err
+	}
+
+	translations, err = loadTranslations(embeddedDir(translationFiles, "i18n"))
+	if err != nil {
+		return err
+	}
+
+	info, err := AppFs.Stat(dbFilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("could not check directory %s: %w", dbFilePath, err)
+		}
+
+		log.Info().Msg("Creating directory: " + dbFilePath)
+		err = createDir(dbFilePath, config.DataDirMode)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not create directory: " + dbFilePath)
+			return fmt.Errorf("could not create directory %s: %w", dbFilePath, err)
+		}
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s exists but is not a directory", dbFilePath)
+	}
+
+	var dbFile = dbFilePath + afero.FilePathSeparator + appName + ".db"
+	err = createFile(dbFile, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create database file %s: %w", dbFile, err)
+	}
+
+	dbDataSource = dataSourceName(dbFile)
+	db, err := sql.Open(dbDriver, dbDataSource)
+	if err != nil {
+		return fmt.Errorf("could not open database %s: %w", dbFile, err)
+	}
+	logPragmas(db)
+
+	// Keeps startup from hanging on a database another process holds locked
+	ctx, cancel := context.WithTimeout(context.Background(), config.StartupTimeout)
+	defer cancel()
+	err = initDatabase(ctx, db)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("could not migrate database: %w", err)
+	}
+
+	swapDB(db)
+	onShutdown("database", func(ctx context.Context) error {
+		return getDB().Close()
+	})
+	return nil
+}
+
+// dataDir is the directory the database and other files the app keeps are stored in.
+func dataDir() (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not find the home directory: %w", err)
+	}
+
+	return dirname + afero.FilePathSeparator + appName, nil
+}
+
+// createDir creates the directory (and any parents) and then sets the mode explicitly, so the umask can't loosen or
+// tighten it.
+func createDir(path string, mode os.FileMode) error {
+	err := AppFs.MkdirAll(path, mode)
+	if err != nil {
+		return err
+	}
+
+	return AppFs.Chmod(path, mode)
+}
+
+// createFile creates an empty file with the given mode, unless it already exists.
+func createFile(path string, mode os.FileMode) error {
+	file, err := AppFs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return AppFs.Chmod(path, mode)
+}
+
+func main() {
+	parseFlags()
+	if showVersion {
+		fmt.Println(getBuildInfo())
+		return
+	}
+	if checkMigrations {
+		if !validateMigrations(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if config.Debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+
+	err := validateConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid configuration")
+		os.Exit(1)
+	}
+
+	err = startup()
+	if err != nil {
+		log.Error().Err(err).Msg("Startup failed")
+		os.Exit(1)
+	}
+
+	if config.AccessLog != "" {
+		accessLog, err = openAccessLog(config.AccessLog)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not open the access log")
+			os.Exit(1)
+		}
+	}
+
+	err = server()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownGrace)
+	runShutdownHooks(ctx)
+	cancel()
+
+	// A supervisor has to see a server that couldn't listen or stopped on its own as a failure
+	if err != nil {
+		log.Error().Err(err).Msg("Server failed")
+		os.Exit(1)
+	}
+}
+
+// serverStarted is set when server() starts, for /uptime.
+var serverStarted time.Time
+
+// server serves until it gets SIGINT or SIGTERM, which is a clean stop and returns nil. It returns an error when it
+// can't listen on one of its addresses or one of the servers stops on its own.
+func server() error {
+	serverStarted = time.Now()
+	log.Info().Msg("Configuring server")
+	events = NewEventBus(config.EventBuffer)
+	go logEvents(events.Subscribe(allTopics))
+
+	if len(config.WebhookURLs) > 0 {
+		topics := config.WebhookTopics
+		if len(topics) == 0 {
+			topics = []string{allTopics}
+		}
+		subscriptions := make([]<-chan Event, 0, len(topics))
+		for _, topic := range topics {
+			subscriptions = append(subscriptions, events.Subscribe(topic))
+		}
+		webhooks := startWebhookDispatcher(subscriptions, config.WebhookURLs, config.WebhookWorkers)
+		onShutdown("webhooks", func(ctx context.Context) error {
+			return webhooks.Drain(ctx, config.EventDrainTimeout)
+		})
+	}
+	// Registered after the webhooks so it runs before them, closing the bus lets the webhook workers finish
+	onShutdown("event bus", func(ctx context.Context) error {
+		events.Close()
+		return nil
+	})
+	routes := newRoutes()
+
+	log.Info().Msg("Starting server")
+	srv := newServer(routes.handler, serverAddr())
+
+	listenConfig := net.ListenConfig{KeepAlive: config.KeepAlivePeriod}
+	if !config.KeepAlives {
+		// A negative period turns TCP keep-alive probes off
+		listenConfig.KeepAlive = -1
+	}
+	if config.ReusePort {
+		if reusePortSupported {
+			listenConfig.Control = reusePortControl
+		} else {
+			log.Warn().Msg("SO_REUSEPORT is not supported on this platform, ignoring -reuse-port")
+		}
+	}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", srv.Addr, err)
+	}
+	listener = limitConnsPerIP(listener, config.MaxConnsPerIP)
+
+	// One for each server, so none of them blocks when they all stop
+	serveErrors := make(chan error, 3)
+	go func() {
+		if tlsConfig != nil {
+			srv.TLSConfig = tlsConfig
+			serveErrors <- srv.ServeTLS(listener, config.TLSCert, config.TLSKey)
+			return
+		}
+		serveErrors <- srv.Serve(listener)
+	}()
+
+	// Servers running next to the main one, they are shut down together with it
+	var sideServers []*http.Server
+	if routes.internalHandler != nil {
+		internalSrv, err := startSideServer(routes.internalHandler, config.AdminAddr, serveErrors)
+		if err != nil {
+			shutdown(srv, config.ShutdownGrace)
+			return fmt.Errorf("could not listen on the admin address %s: %w", config.AdminAddr, err)
+		}
+		log.Info().Msg("Serving the admin and debug endpoints on " + internalSrv.Addr)
+		sideServers = append(sideServers, internalSrv)
+	}
+	if acmeManager != nil {
+		// Answers the HTTP-01 challenges and redirects everything else to https
+		challengeSrv, err := startSideServer(acmeManager.HTTPHandler(nil), config.ACMEHTTPAddr, serveErrors)
+		if err != nil {
+			shutdown(srv, config.ShutdownGrace)
+			for _, side := range sideServers {
+				shutdown(side, config.ShutdownGrace)
+			}
+			return fmt.Errorf("could not listen on the ACME challenge address %s: %w", config.ACMEHTTPAddr, err)
+		}
+		log.Info().Msg("Answering ACME challenges on " + challengeSrv.Addr)
+		sideServers = append(sideServers, challengeSrv)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	if config.DumpOnSignal {
+		stopDump := make(chan struct{})
+		defer close(stopDump)
+		dumpOnSignal(routes.routers, stopDump)
+	}
+
+	var serveErr error
+	select {
+	case serveErr = <-serveErrors:
+		log.Error().Err(serveErr).Msg("A server stopped, shutting the others down")
+	case sig := <-stop:
+		log.Info().Msg("Received " + sig.String() + ", shutting down")
+	}
+
+	// Shut the side servers down at the same time as the main server, so the grace period is shared
+	var stopped sync.WaitGroup
+	for _, side := range sideServers {
+		stopped.Add(1)
+		go func(side *http.Server) {
+			defer stopped.Done()
+			shutdown(side, config.ShutdownGrace)
+		}(side)
+	}
+	shutdown(srv, config.ShutdownGrace)
+	stopped.Wait()
+
+	if serveErr != nil {
+		return fmt.Errorf("server stopped: %w", serveErr)
+	}
+
+	return nil
+}
+
+// newServer returns the main server, with the timeouts and -keep-alives applied.
+func newServer(handler http.Handler, addr string) *http.Server {
+	srv := &http.Server{
+		Handler: handler,
+		Addr:    addr,
+		// Good practice: enforce timeouts for servers you create!
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	srv.SetKeepAlivesEnabled(config.KeepAlives)
+
+	return srv
+}
+
+// serverRoutes are the handlers of the servers.
+type serverRoutes struct {
+	// handler serves the main address, the router wrapped in the middleware chain
+	handler http.Handler
+	// internalHandler serves -admin-addr, it is nil without one
+	internalHandler http.Handler
+	// routers are listed by dumpOnSignal
+	routers []*mux.Router
+}
+
+// newRoutes builds the routers of the main and internal servers from the config.
+func newRoutes() serverRoutes {
+	myRouter := mux.NewRouter().StrictSlash(true)
+	myRouter.Use(configMiddleware)
+	myRouter.Use(localeMiddleware)
+	myRouter.Use(routeTemplateMiddleware)
+
+	// Not part of a CORS route group and not logged, it only shows the HTTP server is up.
+	myRouter.HandleFunc("/ping", pingHandler).Methods(http.MethodGet)
+
+	// Middleware wrapped around the router runs before routing. The last one wrapped runs first.
+	var handler http.Handler = myRouter
+	handler = gzipMiddleware(config.CompressionLevel)(handler)
+	handler = decompressRequestMiddleware(config.MaxBodySize)(handler)
+	handler = recoveryMiddleware(handler)
+	handler = metricsMiddleware(handler)
+	handler = concurrencyLimitMiddleware(config.MaxConcurrent, config.MaxQueueWait)(handler)
+	// Rejects over the limit clients before they take a concurrency slot
+	handler = rateLimitMiddleware(newRateLimitStore(config.RateLimitStore), config.RateLimit, config.RateLimitWindow)(handler)
+	handler = pathAllowlistMiddleware(config.AllowedPaths)(handler)
+	handler = disabledMethodsMiddleware(config.DisabledMethods, config.MethodExemptPaths)(handler)
+	handler = loggingMiddleware(handler)
+	handler = requestIDMiddleware(handler)
+	// Runs before the request ID, logging and routing, so they only ever see canonical paths. The host, URL length
+	// and https checks wrapped around it don't depend on repeated slashes.
+	handler = normalizeSlashesMiddleware(handler)
+	handler = hstsMiddleware(config.HSTSMaxAge, config.HSTSIncludeSubDomains)(handler)
+	handler = httpsRedirectMiddleware(config.HTTPSRedirect)(handler)
+	// Checked before the https redirect, which sends clients to the Host of the request
+	handler = allowedHostsMiddleware(config.AllowedHosts)(handler)
+	handler = maxPathSegmentsMiddleware(config.MaxPathSegments)(handler)
+	handler = maxURLLengthMiddleware(config.MaxURLLength)(handler)
+	// Outermost, so the errors of the other middleware get a charset too
+	handler = charsetMiddleware(config.DefaultCharset)(handler)
+
+	// API routes only answer cross-origin requests from the allowed origins.
+	apiRouter := myRouter.NewRoute().Subrouter()
+	apiRouter.Use(corsMiddleware(apiCorsPolicy))
+	apiRouter.Use(contentTypeMiddleware(config.ContentTypes))
+	apiRouter.Use(apiVersionMiddleware(config.APIVersions))
+	apiRouter.HandleFunc("/helloworld", helloWorldHandler).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/hellovars/{var1}/{var2}", helloVarsHandler).Methods(http.MethodGet)
+	apiRouter.Handle("/buildinfo", cacheMiddleware(config.CacheTTL, config.CacheEntries)(http.HandlerFunc(buildInfoHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/health", healthHandler).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/readyz", readyHandler).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/uptime", uptimeHandler).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/diagnostics", diagnosticsHandler).Methods(http.MethodGet)
+
+	// Admin and debug routes are served by the internal server when -admin-addr is set. Without it they are served by
+	// the main server, which is public, so all of them need the -admin-token there.
+	var internalRouter *mux.Router
+	var internalHandler http.Handler
+	if config.AdminAddr != "" {
+		internalRouter = mux.NewRouter().StrictSlash(true)
+		internalRouter.Use(configMiddleware)
+		internalRouter.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+		internalRouter.MethodNotAllowedHandler = methodNotAllowedHandler(internalRouter)
+		internalHandler = charsetMiddleware(config.DefaultCharset)(recoveryMiddleware(loggingMiddleware(requestIDMiddleware(internalRouter))))
+	} else {
+		internalRouter = myRouter.NewRoute().Subrouter()
+		internalRouter.Use(adminTokenMiddleware)
+	}
+	// requireToken puts a route of the internal server behind the -admin-token, on the main server they all are
+	requireToken := func(handler http.Handler, required bool) http.Handler {
+		if !required || internalHandler == nil {
+			return handler
+		}
+		return adminTokenMiddleware(handler)
+	}
+
+	internalRouter.HandleFunc("/metrics", metricsHandler).Methods(http.MethodGet)
+
+	// Admin routes need the -admin-token as a bearer token.
+	adminRouter := internalRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(func(next http.Handler) http.Handler {
+		return requireToken(next, true)
+	})
+	adminRouter.HandleFunc("/flags", listFlagsHandler).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/flags/{name}", setFlagHandler).Methods(http.MethodPut)
+	adminRouter.HandleFunc("/backup", backupHandler).Methods(http.MethodGet)
+
+	if config.Debug {
+		recentRequests = newRequestLog(config.DebugRequests)
+		internalRouter.HandleFunc("/debug/requests", debugRequestsHandler).Methods(http.MethodGet)
+		internalRouter.HandleFunc("/config", configHandler).Methods(http.MethodGet)
+		adminRouter.HandleFunc("/migrate", migrateHandler).Methods(http.MethodPost)
+
+		internalRouter.PathPrefix("/debug/pprof").Handler(requireToken(pprofHandler(), config.PprofRequireToken))
+		internalRouter.Handle("/debug/stats", requireToken(http.HandlerFunc(debugStatsHandler), config.StatsRequireToken)).Methods(http.MethodGet)
+	}
+
+	// Note: the index, and static files handlers need to be after the routes because they are more generic routes.
+	publicRouter := myRouter.NewRoute().Subrouter()
+	publicRouter.Use(corsMiddleware(publicCorsPolicy))
+	publicRouter.Use(sessionMiddleware)
+	publicRouter.Use(csrfMiddleware)
+	publicRouter.HandleFunc("/", homePageHandler)
+	publicRouter.PathPrefix("/ui/").Handler(http.StripPrefix("/ui", staticFileHandler(uiFiles())))
+	// Unknown asset versions fall through to the not found handler
+	for _, assetVersion := range assetVersions {
+		publicRouter.PathPrefix("/assets/" + assetVersion + "/").Handler(http.StripPrefix("/assets/"+assetVersion, staticFileHandler(assetFiles(assetVersion))))
+	}
+
+	// Anything else gets the same JSON 404 as a missing static file
+	myRouter.NotFoundHandler = corsMiddleware(publicCorsPolicy)(http.HandlerFunc(notFoundHandler))
+	myRouter.MethodNotAllowedHandler = methodNotAllowedHandler(myRouter)
+
+	routers := []*mux.Router{myRouter}
+	if internalHandler != nil {
+		routers = append(routers, internalRouter)
+	}
+
+	return serverRoutes{handler: handler, internalHandler: internalHandler, routers: routers}
+}
+
+// startSideServer serves handler on addr in the background. The error Serve returns is sent to serveErrors.
+func startSideServer(handler http.Handler, addr string, serveErrors chan<- error) (*http.Server, error) {
+	side := &http.Server{
+		Handler:      handler,
+		Addr:         addr,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	listener, err := net.Listen("tcp", side.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		serveErrors <- side.Serve(listener)
+	}()
+
+	return side, nil
+}
+
+// shutdown stops accepting new connections and gives open ones the grace period to finish. Connections still open
+// after that are closed.
+func shutdown(srv *http.Server, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		log.Info().Msg("All connections finished, server stopped")
+		return
+	}
+
+	log.Warn().Err(err).Msg("Grace period of " + grace.String() + " is over, closing the remaining connections")
+	err = srv.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("")
+	}
+}
+
+// *********************************************************
+// Middleware
+// *********************************************************
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 {
+			r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
+		}
+		if r.URL.Path == "/ping" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		// Call the next handler, which can be another middleware in the chain, or the final handler.
+		next.ServeHTTP(recorder, r)
+		elapsed := time.Since(start)
+
+		event := requestLogEvent(r.URL.Path, recorder.Status(), elapsed)
+		if event != nil {
+			if config.LogClientHeaders {
+				event = event.Str("user_agent", stripNewlines(r.UserAgent())).Str("referer", stripNewlines(r.Referer()))
+			}
+			event.Int("status", recorder.Status()).Int64("bytes", recorder.Bytes()).Dur("duration", elapsed).Msg("Incomming request to \"" + r.RequestURI + "\"")
+		}
+
+		if recentRequests != nil {
+			recentRequests.add(RequestLogEntry{
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				Status:   recorder.Status(),
+				Bytes:    recorder.Bytes(),
+				Duration: elapsed.String(),
+				Time:     start,
+			})
+		}
+
+		if accessLog != nil {
+			accessLog.write(AccessLogEntry{
+				Time:       start.UTC(),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     recorder.Status(),
+				DurationMs: float64(elapsed) / float64(time.Millisecond),
+				Bytes:      recorder.Bytes(),
+				RequestID:  requestInfoFromContext(r.Context()).ID,
+				IP:         clientIP(r),
+			})
+		}
+	})
+}
+
+// requestCount is used to pick the requests that are logged when -log-sample-rate is above 1.
+var requestCount uint64
+
+// requestLogEvent returns the log event for a finished request, or nil when it was left out by -log-exclude-paths or
+// sampling. Server errors and slow requests are always logged, as a warning.
+func requestLogEvent(path string, status int, elapsed time.Duration) *zerolog.Event {
+	if status >= http.StatusInternalServerError || (config.SlowRequest > 0 && elapsed > config.SlowRequest) {
+		return log.Warn()
+	}
+	if hasPathPrefix(path, config.LogExcludePaths) {
+		return nil
+	}
+
+	if atomic.AddUint64(&requestCount, 1)%uint64(config.LogSampleRate) != 0 {
+		return nil
+	}
+
+	return log.Info()
+}
+
+// stripNewlines keeps client supplied values from breaking up log lines
+func stripNewlines(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// statusRecorder remembers the status code and counts the body bytes written by the handlers it wraps.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Status returns the status code sent to the client, 200 when the handler didn't set one.
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Bytes returns the number of body bytes sent to the client, after compression when it wraps gzipMiddleware.
+func (r *statusRecorder) Bytes() int64 {
+	return r.bytes
+}
+
+// recoveryMiddleware turns a panic in a handler into a 500 response, so one bad request can't take the server down.
+// Browsers get the errors/500.html page, other clients a JSON error.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Used by handlers to abort the response on purpose, net/http deals with it
+				panic(recovered)
+			}
+
+			log.Error().Str("panic", fmt.Sprint(recovered)).Bytes("stack", debug.Stack()).Msg("Recovered from a panic in a handler")
+			if preferredMediaType(r, "text/html", "application/json") == "text/html" {
+				renderPage(w, http.StatusInternalServerError, "errors/500.html", nil)
+				return
+			}
+
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// alwaysAllowedPaths can't be blocked by -allow-paths, so health checks keep working.
+var alwaysAllowedPaths = []string{"/health", "/readyz", "/ping"}
+
+// pathAllowlistMiddleware answers 404 for every path that isn't under one of the allowed prefixes. An empty allowlist
+// lets everything through. The response is the same as for a missing route, so blocked routes can't be told apart.
+func pathAllowlistMiddleware(allowed []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasPathPrefix(r.URL.Path, alwaysAllowedPaths) || hasPathPrefix(r.URL.Path, allowed) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			log.Debug().Msg("Path not allowed: " + r.URL.Path)
+			notFoundHandler(w, r)
+		})
+	}
+}
+
+// hasPathPrefix reports whether the path is one of the prefixes or below one of them. "/hello" matches "/hello" and
+// "/hello/world" but not "/helloworld".
+func hasPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if path == trimmed || strings.HasPrefix(path, trimmed+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+type requestInfoContextKey struct{}
+
+// RequestInfo is stored in the request context by requestIDMiddleware.
+type RequestInfo struct {
+	ID       string
+	Received time.Time
+}
+
+// requestIDMiddleware gives every request an ID, reusing the X-Request-ID header when the client (or a proxy) sent
+// one. The ID is echoed back in the X-Request-ID response header.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := RequestInfo{ID: r.Header.Get("X-Request-ID"), Received: time.Now()}
+		if info.ID == "" {
+			info.ID = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", info.ID)
+		ctx := context.WithValue(r.Context(), requestInfoContextKey{}, info)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestInfoFromContext(ctx context.Context) RequestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(RequestInfo)
+	return info
+}
+
+// maxURLLengthMiddleware answers 414 URI Too Long for URLs longer than max characters. 0 turns the check off.
+func maxURLLengthMiddleware(max int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			length := len(r.URL.String())
+			if length > max {
+				log.Warn().Int("length", length).Msg("Rejected request with a URL that is too long")
+				http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// contentTypeMiddleware answers 415 Unsupported Media Type for POST, PUT and PATCH requests with a body whose
+// Content-Type isn't one of the allowed media types. Parameters like charset are ignored.
+func contentTypeMiddleware(allowed []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasBody(r) || (r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err == nil {
+				for _, allowedType := range allowed {
+					if strings.EqualFold(mediaType, allowedType) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			writeError(w, http.StatusUnsupportedMediaType, "content type must be one of: "+strings.Join(allowed, ", "))
+		})
+	}
+}
+
+// hasBody reports whether the client sent a request body. The length is -1 when it is unknown, e.g. for chunked bodies.
+func hasBody(r *http.Request) bool {
+	return r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody
+}
+
+// maxPathSegmentsMiddleware answers 400 for paths with more than max segments, e.g. "/a/b/c" has 3. 0 turns the check
+// off.
+func maxPathSegmentsMiddleware(max int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			segments := strings.Count(strings.Trim(r.URL.Path, "/"), "/") + 1
+			if segments > max {
+				log.Warn().Int("segments", segments).Msg("Rejected request with too many path segments")
+				writeError(w, http.StatusBadRequest, "the path has more than "+strconv.Itoa(max)+" segments")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowedHostsMiddleware answers requests whose Host header isn't in allowed with a 400, so links and redirects can't
+// be pointed at another host. "*.example.com" allows the subdomains of example.com. Ports are ignored. An empty list
+// turns the check off.
+func allowedHostsMiddleware(allowed []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hostAllowed(r.Host, allowed) && !hasPathPrefix(r.URL.Path, alwaysAllowedPaths) {
+				log.Warn().Str("host", stripNewlines(r.Host)).Msg("Rejected request for a host that isn't allowed")
+				writeError(w, http.StatusBadRequest, "unknown host")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hostAllowed reports whether host, which may have a port, matches one of the allowed hosts or wildcards.
+func hostAllowed(host string, allowed []string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1 {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeSlashesMiddleware redirects paths with repeated slashes, e.g. "//hellovars/a//b", to the path with the
+// slashes collapsed. The query string is kept.
+func normalizeSlashesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "//") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		canonical := *r.URL
+		canonical.Path = collapseSlashes(r.URL.Path)
+		canonical.RawPath = ""
+		http.Redirect(w, r, canonical.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+func collapseSlashes(path string) string {
+	var builder strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		builder.WriteByte(path[i])
+	}
+
+	return builder.String()
+}
+
+// *********************************************************
+// Route Handlers
+// *********************************************************
+
+// homePageHandler serves the index page to browsers and a short description of the app to JSON clients.
+func homePageHandler(w http.ResponseWriter, r *http.Request) {
+	if prefersJSON(r) {
+		writeJSON(w, http.StatusOK, AppInfo{App: appName, Version: getBuildInfo().Version})
+		return
+	}
+
+	renderPage(w, http.StatusOK, "index.html", nil)
+}
+
+func helloWorldHandler(w http.ResponseWriter, r *http.Request) {
+	locale := localeFromContext(r.Context())
+	setLocaleHeaders(w, locale)
+	renderPage(w, http.StatusOK, "pages/helloworld.html", HelloWorldPage{Lang: locale, Greeting: translate(locale, "greeting")})
+}
+
+// helloVarsHandler echoes the path params. With ?debug=true it also returns details about the request.
+func helloVarsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	locale := localeFromContext(r.Context())
+	setLocaleHeaders(w, locale)
+	response := HelloVars{
+		Var1:     vars["var1"],
+		Var2:     vars["var2"],
+		Greeting: translate(locale, "greetingVars", "var1", vars["var1"], "var2", vars["var2"]),
+	}
+
+	if r.URL.Query().Get("debug") == "true" {
+		info := requestInfoFromContext(r.Context())
+		response.Debug = &RequestDebug{
+			Method:    r.Method,
+			Received:  info.Received.UTC().Format(time.RFC3339Nano),
+			RequestID: info.ID,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// prefersJSON reports whether the Accept header lists application/json before text/html.
+func prefersJSON(r *http.Request) bool {
+	return preferredMediaType(r, "application/json", "text/html") == "application/json"
+}
+
+// preferredMediaType returns the offered media type the Accept header lists first, or "" when it lists none of them.
+func preferredMediaType(r *http.Request, offers ...string) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		for _, offer := range offers {
+			if mediaType == offer {
+				return offer
+			}
+		}
+	}
+
+	return ""
+}
+
+// staticFileHandler serves the files, answering with notFoundHandler instead of the file server's plain text 404
+// when a file doesn't exist.
+func staticFileHandler(files fs.FS) http.Handler {
+	fileServer := http.FileServer(http.FS(files))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = "."
+		}
+
+		_, err := fs.Stat(files, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			notFoundHandler(w, r)
+			return
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
 }
 
-func startup() {
-	dirname, err := os.UserHomeDir()
-	if err != nil {
-		log.Error().Err(err).Msg("")
-	}
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, "not found")
+}
 
-	var AppFs = afero.NewOsFs()
-	var dbFilePath = dirname + afero.FilePathSeparator + appName
+// routeMethods are tried against the router to find out which methods a path has routes for.
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
 
-	_, err = AppFs.Stat(dbFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Info().Msg("Creating directory: " + dbFilePath)
-			AppFs.MkdirAll(dbFilePath, 0754)
-		} else {
-			log.Error().Err(err).Msg("")
+// methodNotAllowedHandler answers 405 with an Allow header listing the methods the path does have routes for.
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, method := range routeMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if router.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
 		}
-	}
 
-	var dbFile = dbFilePath + afero.FilePathSeparator + appName + ".db"
-	db, err := sql.Open("sqlite3", dbFile)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method "+r.Method+" is not allowed, use "+strings.Join(allowed, " or "))
+	})
+}
 
-	if err != nil {
-		log.Error().Err(err).Msg("")
-	}
+// disabledMethodsMiddleware answers requests using one of the disabled methods with a 405 on every path, except the
+// exempt path prefixes, e.g. to run a read-only instance. An empty list turns it off.
+func disabledMethodsMiddleware(disabled []string, exempt []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(disabled) == 0 {
+			return next
+		}
 
-	defer db.Close()
-	initDatabase(db)
+		isDisabled := make(map[string]bool, len(disabled))
+		for _, method := range disabled {
+			isDisabled[strings.ToUpper(method)] = true
+		}
+		var allowed []string
+		for _, method := range routeMethods {
+			if !isDisabled[method] {
+				allowed = append(allowed, method)
+			}
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isDisabled[r.Method] && !hasPathPrefix(r.URL.Path, exempt) {
+				w.Header().Set("Allow", strings.Join(allowed, ", "))
+				writeError(w, http.StatusMethodNotAllowed, "method "+r.Method+" is disabled on this server")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func main() {
-	server()
+// pingHandler doesn't touch the database, so it answers even when /health doesn't.
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("pong"))
 }
 
-func server() {
-	log.Info().Msg("Configuring server")
-	myRouter := mux.NewRouter().StrictSlash(true)
+// healthHandler reports whether the database can be reached.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	err := getDB().PingContext(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Health check failed")
+		respond(w, r, http.StatusServiceUnavailable, Health{Status: "unavailable"})
+		return
+	}
 
-	loggingRouter := loggingMiddleware(myRouter)
+	respond(w, r, http.StatusOK, Health{Status: "ok"})
+}
 
-	myRouter.HandleFunc("/helloworld", helloWorldHandler).Methods(http.MethodGet)
-	myRouter.HandleFunc("/hellovars/{var1}/{var2}", helloVarsHandler).Methods(http.MethodGet)
+// readyHandler answers 503 until the database is reachable and migrated to the newest migration the binary has.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := checkReadiness(r.Context())
+	if readiness.Status != "ok" {
+		respond(w, r, http.StatusServiceUnavailable, readiness)
+		return
+	}
 
-	// Note: the index, and static files handlers need to be after the routes because they are more generic routes.
-	myRouter.HandleFunc("/", homePageHandler)
-	fileServer := http.FileServer(http.FS(staticFiles))
-	myRouter.PathPrefix("/").Handler(fileServer)
+	respond(w, r, http.StatusOK, readiness)
+}
 
-	log.Info().Msg("Starting server")
-	srv := &http.Server{
-		Handler: loggingRouter,
-		Addr:    "127.0.0.1:8081",
-		// Good practice: enforce timeouts for servers you create!
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+// checkReadiness pings the database and compares its version with the newest migration the binary has. The version
+// is -1 when the database can't be reached.
+func checkReadiness(ctx context.Context) Readiness {
+	expected := latestMigrationVersion()
+	db := getDB()
+	err := db.PingContext(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Readiness check failed")
+		return Readiness{Status: "unavailable", DatabaseVersion: -1, ExpectedVersion: expected}
 	}
-	err := srv.ListenAndServe()
+
+	current, err := getCurrentDBVersion(ctx, db)
 	if err != nil {
-		log.Error().Err(err).Msg("")
+		log.Error().Err(err).Msg("Readiness check failed")
+		return Readiness{Status: "unavailable", DatabaseVersion: -1, ExpectedVersion: expected}
+	}
+	if current < expected {
+		log.Warn().Int64("version", current).Int64("expected", expected).Msg("Database is behind the migrations")
+		return Readiness{Status: "migration pending", DatabaseVersion: current, ExpectedVersion: expected}
 	}
 
+	return Readiness{Status: "ok", DatabaseVersion: current, ExpectedVersion: expected}
 }
 
-// *********************************************************
-// Middleware
-// *********************************************************
+func uptimeHandler(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, currentUptime())
+}
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		setupCorsResponse(&w)
-		if len(r.URL.Path) > 1 {
-			r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
-		}
-		// Do stuff here
-		log.Info().Msg("Incomming request to \"" + r.RequestURI + "\"")
-		// Call the next handler, which can be another middleware in the chain, or the final handler.
-		next.ServeHTTP(w, r)
-	})
+func currentUptime() Uptime {
+	uptime := time.Since(serverStarted)
+	return Uptime{
+		StartTime: serverStarted.UTC().Format(time.RFC3339),
+		Uptime:    uptime.Round(time.Second).String(),
+		Seconds:   int64(uptime.Seconds()),
+	}
 }
 
-func setupCorsResponse(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization")
+// diagnosticsHandler puts the database state, build info and uptime in one response. It answers 503 when the
+// database can't be reached, with the other sections still filled in.
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	diagnostics := Diagnostics{
+		Status:   "ok",
+		Database: checkReadiness(r.Context()),
+		Build:    getBuildInfo(),
+		Uptime:   currentUptime(),
+	}
+	if diagnostics.Database.Status == "unavailable" {
+		diagnostics.Status = "unavailable"
+		writeJSON(w, http.StatusServiceUnavailable, diagnostics)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diagnostics)
 }
 
-// *********************************************************
-// Route Handlers
-// *********************************************************
+// writeError sends {"error": message} with the given status
+func writeError(w http.ResponseWriter, status int, message string) {
+	if config.ResponseEnvelope {
+		encodeJSON(w, status, Envelope{Error: &message})
+		return
+	}
 
-func homePageHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	indexFile := getStaticFileText("ui/index.html")
-	w.Write([]byte(indexFile))
+	encodeJSON(w, status, ErrorResponse{Error: message})
 }
 
-func helloWorldHandler(w http.ResponseWriter, r *http.Request) {
-	indexFile := getStaticFileText("ui/pages/helloworld.html")
-	w.Write([]byte(indexFile))
+// writeJSON sends the payload, wrapped in {"data": payload, "error": null} with -envelope.
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	if config.ResponseEnvelope {
+		payload = Envelope{Data: payload}
+	}
+
+	encodeJSON(w, status, payload)
 }
 
-func helloVarsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Path params: %v %v\n", vars["var1"], vars["var2"])
+func encodeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(payload)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+	}
 }
 
 // *********************************************************
 // Database
 // *********************************************************
 
-func initDatabase(db *sql.DB) {
+// dataSourceName adds the configured pragmas to the database file path. The sqlite driver applies them to every new
+// connection in the pool.
+func dataSourceName(dbFile string) string {
+	params := url.Values{}
+	if config.JournalMode != "" {
+		params.Set("_journal_mode", config.JournalMode)
+	}
+	if config.ForeignKeys {
+		params.Set("_foreign_keys", "on")
+	} else {
+		params.Set("_foreign_keys", "off")
+	}
+	params.Set("_busy_timeout", strconv.FormatInt(config.BusyTimeout.Milliseconds(), 10))
+
+	return "file:" + dbFile + "?" + params.Encode()
+}
+
+// logPragmas logs the pragmas the connection actually ended up with, so a setting the driver ignored is noticed.
+func logPragmas(db *sql.DB) {
+	var journalMode string
+	var foreignKeys, busyTimeout int64
+
+	err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if err == nil {
+		err = db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys)
+	}
+	if err == nil {
+		err = db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read database pragmas")
+		return
+	}
+
+	log.Info().Str("journal_mode", journalMode).Int64("foreign_keys", foreignKeys).Int64("busy_timeout", busyTimeout).Msg("Database pragmas")
+	if config.JournalMode != "" && !strings.EqualFold(journalMode, config.JournalMode) {
+		log.Warn().Msg("Database journal mode is " + journalMode + " instead of the configured " + config.JournalMode)
+	}
+}
+
+func initDatabase(ctx context.Context, db *sql.DB) error {
 	log.Info().Msg("==================================")
 	log.Info().Msg("Pinging database")
-	err := db.Ping()
+	err := db.PingContext(ctx)
 	if err != nil {
-		log.Error().Err(err).Msg("")
+		return err
+	}
+
+	dbVersion, err := migrateDatabase(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msg("Current database version: " + strconv.FormatInt(dbVersion, 10))
+
+	err = seedDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msg("==================================")
+	log.Info().Msg("")
+	return nil
+}
+
+// migrationMutex stops two migration runs (startup and /admin/migrate) from overlapping.
+var migrationMutex sync.Mutex
+
+// migrateDatabase creates the version table when it is missing and then runs every v<n>.sql script above the current
+// version, in order. Each script has to insert its own version number. It returns the version the database ends up at.
+// The scripts still pending are run again, up to -migration-retries times, when the driver reports an error that
+// can go away on its own. Any other error, e.g. bad SQL, is returned right away.
+func migrateDatabase(ctx context.Context, db *sql.DB) (int64, error) {
+	migrationMutex.Lock()
+	defer migrationMutex.Unlock()
+
+	backoff := config.MigrationRetryBackoff
+	dbVersion, err := runMigrations(ctx, db)
+
+	for attempt := 1; attempt <= config.MigrationRetries && isTransientDBError(err); attempt++ {
+		log.Warn().Err(err).Int("attempt", attempt).Msg("Migration failed, retrying in " + backoff.String())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return dbVersion, err
+		}
+		backoff *= 2
+		dbVersion, err = runMigrations(ctx, db)
+	}
+
+	return dbVersion, err
+}
+
+// runMigrations does one migrateDatabase attempt. Every script runs in its own transaction, so a failed attempt
+// leaves the database at the version of the last script that worked.
+func runMigrations(ctx context.Context, db *sql.DB) (int64, error) {
+	dbVersion, err := getCurrentDBVersion(ctx, db)
+	if err != nil {
+		return dbVersion, err
 	}
-	dbVersion := getCurrentDBVersion(db)
 
 	if dbVersion == -1 {
 		log.Info().Msg("No \"version\" table.")
-		executeScript(db, getSqlFileText("sql/init.sql"), "Version table init script (version 0)")
-		dbVersion = getCurrentDBVersion(db)
+		err := executeScript(db, getSqlFileText("init.sql"), "Version table init script (version 0)")
+		if err != nil {
+			return dbVersion, err
+		}
+		dbVersion, err = getCurrentDBVersion(ctx, db)
+		if err != nil {
+			return dbVersion, err
+		}
 	}
 
-	if dbVersion == 0 {
-		executeScript(db, getSqlFileText("sql/v1.sql"), "Version 1 script")
-		dbVersion = getCurrentDBVersion(db)
-	}
+	for {
+		nextVersion := dbVersion + 1
+		path := "v" + strconv.FormatInt(nextVersion, 10) + ".sql"
+		if _, err := fs.Stat(migrationFiles(), path); err != nil {
+			break
+		}
 
-	log.Info().Msg("Current database version: " + string(dbVersion))
+		err := executeScript(db, getSqlFileText(path), "Version "+strconv.FormatInt(nextVersion, 10)+" script")
+		if err != nil {
+			return dbVersion, err
+		}
 
-	// Note: the version of sqlite3 that this library is using does not support running scripts (multiple queries in one execute statement) The below only runs the first query:
-	//executeSingleStatement(db, "insert into version (version) values (0);insert into version (version) values (1);")
+		dbVersion, err = getCurrentDBVersion(ctx, db)
+		if err != nil {
+			return dbVersion, err
+		}
+		if dbVersion != nextVersion {
+			return dbVersion, fmt.Errorf("script %s did not set the database version to %d", path, nextVersion)
+		}
+	}
 
-	log.Info().Msg("==================================")
-	log.Info().Msg("")
+	return dbVersion, nil
 }
 
-/**
-Note: The sql script can only contain sql statements (no comments) and each comment must end with a semicolon.
-*/
-func executeScript(db *sql.DB, scriptText string, scriptName string) {
-	err := executeSingleStatement(db, "BEGIN TRANSACTION;")
+// latestMigrationVersion returns the highest version migrateDatabase would bring the database to, 0 when there are no
+// v<n>.sql scripts.
+func latestMigrationVersion() int64 {
+	var version int64
+	for {
+		path := "v" + strconv.FormatInt(version+1, 10) + ".sql"
+		if _, err := fs.Stat(migrationFiles(), path); err != nil {
+			return version
+		}
+		version++
+	}
+}
 
+// validateMigrations runs init.sql and every v<n>.sql script, in order, against a new in-memory database and writes
+// a line per script to out. It stops at the first script that fails, the later ones depend on it, and returns false.
+// The real database isn't opened.
+func validateMigrations(out io.Writer) bool {
+	db, err := sql.Open(dbDriver, ":memory:")
 	if err != nil {
-		log.Error().Err(err)
+		fmt.Fprintf(out, "FAIL could not open an in-memory database: %v\n", err)
+		return false
+	}
+	defer db.Close()
+	// Every connection to :memory: gets a database of its own
+	db.SetMaxOpenConns(1)
+
+	scripts := []string{"init.sql"}
+	for version := int64(1); version <= latestMigrationVersion(); version++ {
+		scripts = append(scripts, "v"+strconv.FormatInt(version, 10)+".sql")
+	}
+
+	for i, script := range scripts {
+		text, err := fs.ReadFile(migrationFiles(), script)
+		if err == nil {
+			err = executeScript(db, string(text), script)
+		}
+		if err == nil {
+			var version int64
+			version, err = getCurrentDBVersion(context.Background(), db)
+			if err == nil && version != int64(i) {
+				err = fmt.Errorf("the script set the database version to %d instead of %d", version, i)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", script, err)
+			return false
+		}
+		fmt.Fprintf(out, "ok   %s\n", script)
 	}
 
+	return true
+}
+
+/**
+Note: The sql script can only contain sql statements (no comments) and each comment must end with a semicolon.
+*/
+func executeScript(db *sql.DB, scriptText string, scriptName string) error {
 	log.Info().Msg("Executing script: " + scriptName)
 	commands := strings.Split(scriptText, ";")
+	statements := make([]string, 0, len(commands))
 
 	for c := 0; c < len(commands); c++ {
 		command := commands[c]
@@ -193,62 +1356,217 @@ func executeScript(db *sql.DB, scriptText string, scriptName string) {
 		command = strings.ReplaceAll(command, "\n", "")
 
 		if len(command) > 0 {
-			err := executeSingleStatement(db, command)
+			statements = append(statements, command)
+		}
+	}
+
+	err := executeStatements(db, statements)
+	if err != nil {
+		log.Error().Err(err).Msg("Rolled back script: " + scriptName)
+		return fmt.Errorf("script %q failed: %w", scriptName, err)
+	}
+
+	return nil
+}
+
+// executeStatements runs the statements in one transaction. If any of them fails the whole transaction is rolled back.
+func executeStatements(db *sql.DB, statements []string) error {
+	return withLockRetry(func() error {
+		return withTx(context.Background(), db, func(tx *sql.Tx) error {
+			for _, statement := range statements {
+				start := time.Now()
+				_, err := tx.Exec(statement)
+				logSlowQuery(statement, start)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
 
+// bulkInsert inserts every row in one transaction, reusing a single prepared statement for all of them. Use it for seed
+// data instead of one statement per row. If any row fails, none of the rows are inserted.
+//
+//	bulkInsert(db, "insert into helloworld(content) values(?)", [][]interface{}{{"hello"}, {"world"}})
+func bulkInsert(db *sql.DB, query string, rows [][]interface{}) error {
+	return withLockRetry(func() error {
+		defer logSlowQuery(query, time.Now())
+
+		return withTx(context.Background(), db, func(tx *sql.Tx) error {
+			statement, err := tx.Prepare(query)
 			if err != nil {
-				executeSingleStatement(db, "ROLLBACK;")
-				log.Error().Err(err).Msg("")
+				return err
 			}
-		}
-	}
+			defer statement.Close()
+
+			for _, row := range rows {
+				_, err = statement.Exec(row...)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
 
-	executeSingleStatement(db, "COMMIT;")
+// seed is the rows a table starts with.
+type seed struct {
+	table string
+	query string
+	rows  [][]interface{}
 }
 
-func executeSingleStatement(db *sql.DB, query string) error {
+// seeds are loaded by seedDatabase after the migrations. The migration scripts only create the schema.
+var seeds = []seed{
+	{table: "helloworld", query: "insert into helloworld(content) values(?)", rows: [][]interface{}{{"helloworld"}}},
+}
+
+// seedDatabase inserts the seed rows of every table that is still empty, with bulkInsert.
+func seedDatabase(db *sql.DB) error {
+	for _, s := range seeds {
+		var seeded bool
+		err := db.QueryRow("select exists(select 1 from " + s.table + ")").Scan(&seeded)
+		if err != nil {
+			return err
+		}
+		if seeded {
+			continue
+		}
+
+		log.Info().Int("rows", len(s.rows)).Msg("Seeding table " + s.table)
+		err = bulkInsert(db, s.query, s.rows)
+		if err != nil {
+			return fmt.Errorf("seeding %s failed: %w", s.table, err)
+		}
+	}
 
-	statement, err := db.Prepare(query)
+	return nil
+}
 
+// withTx runs fn in a transaction. The transaction is committed when fn returns nil and rolled back when it returns an
+// error or panics. A panic is passed on after the rollback.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	_, err = statement.Exec()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			rollback(tx)
+			panic(recovered)
+		}
+	}()
 
+	err = fn(tx)
 	if err != nil {
+		rollback(tx)
 		return err
 	}
 
+	return tx.Commit()
+}
+
+func rollback(tx *sql.Tx) {
+	err := tx.Rollback()
+	if err != nil && !errors.Is(err, sql.ErrTxDone) {
+		log.Error().Err(err).Msg("Rollback failed")
+	}
+}
+
+// maxLoggedQueryLength keeps long migration scripts from flooding the log.
+const maxLoggedQueryLength = 200
+
+// logSlowQuery logs a warning when the query started at start took longer than -slow-query. Call it with defer:
+//
+//	defer logSlowQuery(query, time.Now())
+func logSlowQuery(query string, start time.Time) {
+	elapsed := time.Since(start)
+	if config.SlowQuery <= 0 || elapsed < config.SlowQuery {
+		return
+	}
+
+	if len(query) > maxLoggedQueryLength {
+		query = query[:maxLoggedQueryLength] + "..."
+	}
+	log.Warn().Str("query", query).Dur("elapsed", elapsed).Msg("Slow query")
+}
+
+// withLockRetry calls fn again, with a doubling backoff, while sqlite reports that the database is locked.
+// Any other error is returned straight away.
+func withLockRetry(fn func() error) error {
+	backoff := config.DBLockRetryBackoff
+	err := fn()
+
+	for attempt := 1; attempt <= config.DBLockRetries && isLockError(err); attempt++ {
+		log.Warn().Err(err).Int("attempt", attempt).Msg("Database is locked, retrying in " + backoff.String())
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+
 	return err
 }
 
-func getCurrentDBVersion(db *sql.DB) int64 {
-	rows, err := db.Query("select max(version) as version from version")
+// isTransientDBError reports whether err can go away when the same statements are run again: the database was locked
+// or busy, or the connection to it failed.
+func isTransientDBError(err error) bool {
+	if isLockError(err) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
 
-	if err != nil {
-		if err.Error() == "no such table: version" {
-			return -1
-		}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrIoErr || sqliteErr.Code == sqlite3.ErrProtocol
+	}
 
-		log.Error().Err(err).Msg("")
+	return false
+}
+
+func isLockError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
 	}
 
-	version := Version{Version: -1}
+	return strings.Contains(err.Error(), "database is locked")
+}
 
-	rows.Next()
-	err = rows.Scan(&version.Version)
+// getCurrentDBVersion returns -1 when there is no version table yet.
+func getCurrentDBVersion(ctx context.Context, db *sql.DB) (int64, error) {
+	query := "select max(version) as version from version"
+	start := time.Now()
+	var version sql.NullInt64
+	err := db.QueryRowContext(ctx, query).Scan(&version)
+	logSlowQuery(query, start)
 
 	if err != nil {
-		rows.Close()
-		log.Error().Err(err).Msg("")
+		if err.Error() == "no such table: version" {
+			return -1, nil
+		}
+
+		return -1, fmt.Errorf("could not read the database version: %w", err)
+	}
+	if !version.Valid {
+		// The table is there but empty
+		return -1, nil
 	}
 
-	rows.Close()
-	return version.Version
+	return version.Int64, nil
 }
 
+// getSqlFileText returns a file from the sql directory, e.g. "v1.sql"
 func getSqlFileText(path string) string {
-	data, err := sqlFiles.ReadFile(path)
+	data, err := fs.ReadFile(migrationFiles(), path)
 	if err != nil {
 		log.Error().Err(err).Msg("")
 	}
@@ -256,19 +1574,140 @@ func getSqlFileText(path string) string {
 	return string(data)
 }
 
-func getStaticFileText(path string) string {
-	data, err := staticFiles.ReadFile(path)
+// migrationFiles returns the sql scripts. They are read from -sql-dir when it is set, so new migrations can be tried
+// without rebuilding, and from the embedded files otherwise. A script can be stored gzipped, as v<n>.sql.gz, to keep
+// large migrations from growing the binary. It is decompressed when it is read.
+func migrationFiles() fs.FS {
+	if config.SQLDir != "" {
+		return gunzipFS{os.DirFS(config.SQLDir)}
+	}
+
+	return gunzipFS{sqlSource}
+}
+
+// uiFiles returns the files in the ui directory. They are read from -static-dir when it is set, so frontend changes
+// show up without rebuilding, and from the embedded files otherwise.
+func uiFiles() fs.FS {
+	if config.StaticDir != "" {
+		return os.DirFS(config.StaticDir)
+	}
+
+	return uiSource
+}
+
+// requiredUIFiles and requiredSQLFiles are checked by startup(), so a build or -static-dir missing one of them fails
+// right away instead of on the first request.
+var (
+	requiredUIFiles  = []string{"index.html", "pages/helloworld.html", "errors/500.html"}
+	requiredSQLFiles = []string{"init.sql"}
+)
+
+func checkRequiredFiles(files fs.FS, names []string) error {
+	var missing []string
+	for _, name := range names {
+		_, err := fs.Stat(files, name)
+		if err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// uiSource and sqlSource are used by uiFiles and migrationFiles when no directory is configured. They default to the
+// embedded files, tests can swap in their own, e.g. a fstest.MapFS.
+var (
+	uiSource  = embeddedDir(staticFiles, "ui")
+	sqlSource = embeddedDir(sqlFiles, "sql")
+)
+
+// embeddedDir returns a directory of an embed.FS. The names are fixed at compile time, so an error is a bug.
+func embeddedDir(files embed.FS, dir string) fs.FS {
+	sub, err := fs.Sub(files, dir)
+	if err != nil {
+		panic(err)
+	}
+
+	return sub
+}
+
+// assetVersions are the asset bundles under ui/, served at /assets/<version>/.
+var assetVersions = []string{"v1", "v2"}
+
+// assetFiles returns the files of one asset bundle.
+func assetFiles(assetVersion string) fs.FS {
+	files, err := fs.Sub(uiFiles(), assetVersion)
 	if err != nil {
 		log.Error().Err(err).Msg("")
 	}
 
-	return string(data)
+	return files
 }
 
 // *********************************************************
 // Structs
 // *********************************************************
 
+type AppInfo struct {
+	App     string `json:"app"`
+	Version string `json:"version"`
+}
+
+type HelloVars struct {
+	Var1     string        `json:"var1"`
+	Var2     string        `json:"var2"`
+	Greeting string        `json:"greeting"`
+	Debug    *RequestDebug `json:"debug,omitempty"`
+}
+
+type HelloWorldPage struct {
+	Lang     string
+	Greeting string
+}
+
+type RequestDebug struct {
+	Method    string `json:"method"`
+	Received  string `json:"received"`
+	RequestID string `json:"requestId"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Envelope wraps every JSON response with -envelope. Exactly one of Data and Error is null.
+type Envelope struct {
+	Data  interface{} `json:"data"`
+	Error *string     `json:"error"`
+}
+
+type Health struct {
+	Status string `json:"status" xml:"status"`
+}
+
+type Readiness struct {
+	Status          string `json:"status" xml:"status"`
+	DatabaseVersion int64  `json:"databaseVersion" xml:"databaseVersion"`
+	ExpectedVersion int64  `json:"expectedVersion" xml:"expectedVersion"`
+}
+
+type Diagnostics struct {
+	Status   string    `json:"status"`
+	Database Readiness `json:"database"`
+	Build    BuildInfo `json:"build"`
+	Uptime   Uptime    `json:"uptime"`
+}
+
+type Uptime struct {
+	StartTime string `json:"startTime" xml:"startTime"`
+	// Uptime is human readable, e.g. "26h3m12s"
+	Uptime  string `json:"uptime" xml:"uptime"`
+	Seconds int64  `json:"seconds" xml:"seconds"`
+}
+
 type Version struct {
 	Version int64 `json:"version"`
 }
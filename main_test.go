@@ -0,0 +1,1248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// TestMain loads the templates and translations startup would, the handlers rendering pages need them.
+func TestMain(m *testing.M) {
+	var err error
+	pageTemplates, err = loadTemplates(uiFiles())
+	if err == nil {
+		translations, err = loadTranslations(embeddedDir(translationFiles, "i18n"))
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// openTestDB opens a migrated database in a temporary directory and makes it the app database until the test ends.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open(dbDriver, dataSourceName(filepath.Join(t.TempDir(), appName+".db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrateDatabase(context.Background(), db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	previous := swapDB(db)
+	t.Cleanup(func() {
+		swapDB(previous)
+		db.Close()
+	})
+
+	return db
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+
+	var count int
+	err := db.QueryRow("select count(*) from " + table).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestBulkInsert(t *testing.T) {
+	db := openTestDB(t)
+	_, err := db.Exec("create table bulk(n integer unique)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make([][]interface{}, 1000)
+	for i := range rows {
+		rows[i] = []interface{}{i}
+	}
+	err = bulkInsert(db, "insert into bulk(n) values(?)", rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, db, "bulk"); count != 1000 {
+		t.Fatalf("got %d rows, want 1000", count)
+	}
+}
+
+func TestBulkInsertIsAtomic(t *testing.T) {
+	db := openTestDB(t)
+	_, err := db.Exec("create table bulk(n integer unique)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last row breaks the unique constraint, so none of them may be kept
+	rows := make([][]interface{}, 1000)
+	for i := range rows {
+		rows[i] = []interface{}{i}
+	}
+	rows = append(rows, []interface{}{0})
+	err = bulkInsert(db, "insert into bulk(n) values(?)", rows)
+	if err == nil {
+		t.Fatal("expected the duplicate row to fail the insert")
+	}
+	if count := countRows(t, db, "bulk"); count != 0 {
+		t.Fatalf("got %d rows after the failed insert, want 0", count)
+	}
+}
+
+func TestSeedDatabaseOnlySeedsEmptyTables(t *testing.T) {
+	db := openTestDB(t)
+
+	for i := 0; i < 2; i++ {
+		err := seedDatabase(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := countRows(t, db, "helloworld"); count != 1 {
+			t.Fatalf("got %d helloworld rows after seeding %d times, want 1", count, i+1)
+		}
+	}
+}
+
+func TestStartupReturnsError(t *testing.T) {
+	withFs(t, afero.NewMemMapFs())
+
+	dir, err := dataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file where the data directory should be
+	err = afero.WriteFile(AppFs, dir, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = startup()
+	if err == nil {
+		t.Fatal("expected startup to fail when the data directory is a file")
+	}
+}
+
+func TestServerReturnsErrorWhenItCantListen(t *testing.T) {
+	taken, err := net.Listen("tcp", serverAddr())
+	if err != nil {
+		t.Skip("the server address is in use: ", err)
+	}
+	defer taken.Close()
+	t.Cleanup(func() { runShutdownHooks(context.Background()) })
+
+	err = server()
+	if err == nil {
+		t.Fatal("expected server to fail when its address is taken")
+	}
+}
+
+// serve sends the request to handler and returns the recorded response.
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// withEventBus gives handlers a bus to publish to for the test, as server() does.
+func withEventBus(t *testing.T) *EventBus {
+	t.Helper()
+
+	previous := events
+	events = NewEventBus(16)
+	t.Cleanup(func() {
+		events.Close()
+		events = previous
+	})
+
+	return events
+}
+
+func TestMetricsOnlyOnAdminAddr(t *testing.T) {
+	c := config
+	c.AdminAddr = "127.0.0.1:0"
+	withConfig(t, c)
+
+	routes := newRoutes()
+	if status := serve(routes.handler, httptest.NewRequest(http.MethodGet, "/metrics", nil)).Code; status != http.StatusNotFound {
+		t.Errorf("main server answered /metrics with %d, want 404", status)
+	}
+	if status := serve(routes.internalHandler, httptest.NewRequest(http.MethodGet, "/metrics", nil)).Code; status != http.StatusOK {
+		t.Errorf("admin server answered /metrics with %d, want 200", status)
+	}
+}
+
+func TestInternalRoutesNeedTokenOnMainServer(t *testing.T) {
+	c := config
+	c.AdminAddr = ""
+	c.AdminToken = "secret"
+	withConfig(t, c)
+
+	routes := newRoutes()
+	if routes.internalHandler != nil {
+		t.Fatal("expected no admin server without -admin-addr")
+	}
+	if status := serve(routes.handler, httptest.NewRequest(http.MethodGet, "/metrics", nil)).Code; status != http.StatusUnauthorized {
+		t.Errorf("/metrics without the token got %d, want 401", status)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	if status := serve(routes.handler, r).Code; status != http.StatusOK {
+		t.Errorf("/metrics with the token got %d, want 200", status)
+	}
+	// Routes the internal ones don't match aren't affected
+	if status := serve(routes.handler, httptest.NewRequest(http.MethodGet, "/missing", nil)).Code; status != http.StatusNotFound {
+		t.Errorf("/missing got %d, want 404", status)
+	}
+}
+
+func TestWithLockRetryRetriesLockErrors(t *testing.T) {
+	c := config
+	c.DBLockRetries = 5
+	c.DBLockRetryBackoff = time.Millisecond
+	withConfig(t, c)
+
+	calls := 0
+	err := withLockRetry(func() error {
+		calls++
+		if calls < 3 {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("got %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	failure := errors.New("no such table")
+	err = withLockRetry(func() error {
+		calls++
+		return failure
+	})
+	if err != failure || calls != 1 {
+		t.Fatalf("got %v after %d calls, want the error after 1", err, calls)
+	}
+}
+
+func TestWithLockRetrySucceedsOnceTheDatabaseIsFree(t *testing.T) {
+	c := config
+	c.DBLockRetries = 10
+	c.DBLockRetryBackoff = 10 * time.Millisecond
+	withConfig(t, c)
+
+	file := filepath.Join(t.TempDir(), "locked.db")
+	// Without a busy timeout sqlite reports the lock right away, so only withLockRetry waits for it
+	db, err := sql.Open(dbDriver, "file:"+file+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("create table t(n integer)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = holder.Exec("insert into t(n) values(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		holder.Commit()
+	}()
+
+	calls := 0
+	err = withLockRetry(func() error {
+		calls++
+		_, err := db.Exec("insert into t(n) values(2)")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls < 2 {
+		t.Fatalf("the insert ran %d times, expected it to be retried while the database was locked", calls)
+	}
+	if count := countRows(t, db, "t"); count != 2 {
+		t.Fatalf("got %d rows, want 2", count)
+	}
+}
+
+func TestKeepAlivesDisabledClosesConnections(t *testing.T) {
+	for _, keepAlives := range []bool{true, false} {
+		c := config
+		c.KeepAlives = keepAlives
+		withConfig(t, c)
+
+		ts := httptest.NewUnstartedServer(nil)
+		ts.Config = newServer(http.HandlerFunc(pingHandler), "")
+		ts.Start()
+
+		response, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			ts.Close()
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		ts.Close()
+
+		if response.Close == keepAlives {
+			t.Errorf("with keep-alives %v the response had Connection: close %v", keepAlives, response.Close)
+		}
+	}
+}
+
+// withFs replaces AppFs for the test.
+func withFs(t *testing.T, fs afero.Fs) {
+	t.Helper()
+
+	previous := AppFs
+	AppFs = fs
+	t.Cleanup(func() { AppFs = previous })
+}
+
+func TestCreateDirAndFileModes(t *testing.T) {
+	withFs(t, afero.NewMemMapFs())
+
+	err := createDir("/data/app", 0754)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := AppFs.Stat("/data/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0754 {
+		t.Fatalf("got %v, want a directory with mode 0754", info.Mode())
+	}
+
+	err = createFile("/data/app/app.db", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = AppFs.Stat("/data/app/app.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("got %v, want mode 0600", info.Mode())
+	}
+
+	// An existing file is kept as it is
+	err = afero.WriteFile(AppFs, "/data/app/app.db", []byte("data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = createFile("/data/app/app.db", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := afero.ReadFile(AppFs, "/data/app/app.db"); string(content) != "data" {
+		t.Fatalf("createFile changed an existing file to %q", content)
+	}
+}
+
+func TestStartupFailsWhenTheDataDirectoryCantBeCreated(t *testing.T) {
+	withFs(t, afero.NewReadOnlyFs(afero.NewMemMapFs()))
+	log := captureLog(t)
+
+	err := startup()
+	if err == nil || !strings.Contains(err.Error(), "could not create directory") {
+		t.Fatalf("got %v, want startup to fail creating the data directory", err)
+	}
+	if !strings.Contains(log.String(), "Could not create directory") {
+		t.Fatalf("failed MkdirAll not logged: %s", log.String())
+	}
+}
+
+func TestStartupFailsWhenTheDatabaseFileCantBeCreated(t *testing.T) {
+	base := afero.NewMemMapFs()
+	dir, err := dataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = base.MkdirAll(dir, 0754)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFs(t, afero.NewReadOnlyFs(base))
+
+	err = startup()
+	if err == nil {
+		t.Fatal("expected startup to fail when the database file can't be created")
+	}
+}
+
+func TestNormalizeSlashesRedirects(t *testing.T) {
+	handler := normalizeSlashesMiddleware(http.HandlerFunc(pingHandler))
+
+	for target, location := range map[string]string{
+		"//helloworld":       "/helloworld",
+		"/hellovars/a//b":    "/hellovars/a/b",
+		"//hellovars//a?x=1": "/hellovars/a?x=1",
+	} {
+		w := serve(handler, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != location {
+			t.Errorf("%s got %d to %q, want 301 to %q", target, w.Code, w.Header().Get("Location"), location)
+		}
+	}
+
+	w := serve(handler, httptest.NewRequest(http.MethodGet, "/helloworld", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("canonical path got %d, want 200", w.Code)
+	}
+}
+
+func TestHomePageFollowsAccept(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w := serve(http.HandlerFunc(homePageHandler), r)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("got Content-Type %q for a JSON client", w.Header().Get("Content-Type"))
+	}
+	var info AppInfo
+	err := json.Unmarshal(w.Body.Bytes(), &info)
+	if err != nil || info.App != appName {
+		t.Fatalf("got %q, %v, want the app info", w.Body.String(), err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	w = serve(http.HandlerFunc(homePageHandler), r)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("got %d with Content-Type %q for a browser", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestDatabasePragmas(t *testing.T) {
+	db := openTestDB(t)
+
+	var journalMode string
+	var foreignKeys, busyTimeout int64
+	err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if err == nil {
+		err = db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys)
+	}
+	if err == nil {
+		err = db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.EqualFold(journalMode, "wal") {
+		t.Errorf("got journal mode %q, want wal", journalMode)
+	}
+	if foreignKeys != 1 {
+		t.Errorf("got foreign_keys %d, want 1", foreignKeys)
+	}
+	if busyTimeout != config.BusyTimeout.Milliseconds() {
+		t.Errorf("got busy_timeout %d, want %d", busyTimeout, config.BusyTimeout.Milliseconds())
+	}
+}
+
+func TestHelloVarsDebugOnlyWhenRequested(t *testing.T) {
+	handler := newRoutes().handler
+
+	for target, wantDebug := range map[string]bool{
+		"/hellovars/a/b":            false,
+		"/hellovars/a/b?debug=true": true,
+	} {
+		w := serve(handler, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s got %d, want 200", target, w.Code)
+		}
+
+		var vars HelloVars
+		err := json.Unmarshal(w.Body.Bytes(), &vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vars.Var1 != "a" || vars.Var2 != "b" {
+			t.Errorf("%s got vars %q and %q", target, vars.Var1, vars.Var2)
+		}
+		if (vars.Debug != nil) != wantDebug {
+			t.Errorf("%s got debug %+v", target, vars.Debug)
+		}
+		if wantDebug && vars.Debug.Method != http.MethodGet {
+			t.Errorf("%s got debug method %q", target, vars.Debug.Method)
+		}
+	}
+}
+
+func TestStaticDirServesFilesFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "local.txt"), []byte("from disk"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config
+	c.StaticDir = dir
+	withConfig(t, c)
+
+	w := serve(newRoutes().handler, httptest.NewRequest(http.MethodGet, "/ui/local.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "from disk" {
+		t.Fatalf("got %d %q, want the file from -static-dir", w.Code, w.Body.String())
+	}
+}
+
+func TestShutdownWaitsForTheGracePeriod(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		handlerTime time.Duration
+		grace       time.Duration
+		wantOK      bool
+	}{
+		{"finishes within the grace period", 20 * time.Millisecond, time.Second, true},
+		{"closed after the grace period", 5 * time.Second, 50 * time.Millisecond, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			started := make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(test.handlerTime):
+				case <-r.Context().Done():
+				}
+				w.Write([]byte("done"))
+			}))
+			defer ts.Close()
+
+			result := make(chan error, 1)
+			go func() {
+				response, err := ts.Client().Get(ts.URL)
+				if err == nil {
+					_, err = io.ReadAll(response.Body)
+					response.Body.Close()
+				}
+				result <- err
+			}()
+			<-started
+
+			start := time.Now()
+			shutdown(ts.Config, test.grace)
+			elapsed := time.Since(start)
+
+			err := <-result
+			if test.wantOK && err != nil {
+				t.Fatalf("the request failed during a graceful shutdown: %v", err)
+			}
+			if !test.wantOK && err == nil {
+				t.Fatal("expected the request to be cut off after the grace period")
+			}
+			if elapsed > test.grace+time.Second {
+				t.Fatalf("shutdown took %v with a grace period of %v", elapsed, test.grace)
+			}
+		})
+	}
+}
+
+func TestPathAllowlist(t *testing.T) {
+	handler := pathAllowlistMiddleware([]string{"/helloworld"})(http.HandlerFunc(pingHandler))
+
+	for path, want := range map[string]int{
+		"/helloworld":     http.StatusOK,
+		"/hellovars/a/b":  http.StatusNotFound,
+		"/helloworldwide": http.StatusNotFound,
+		"/health":         http.StatusOK,
+	} {
+		if got := serve(handler, httptest.NewRequest(http.MethodGet, path, nil)).Code; got != want {
+			t.Errorf("%s got %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestPingWithoutDatabase(t *testing.T) {
+	closed, err := sql.Open(dbDriver, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	handler := newRoutes().handler
+	for _, db := range []*sql.DB{nil, closed} {
+		previous := swapDB(db)
+		w := serve(handler, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		swapDB(previous)
+
+		if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "pong" {
+			t.Errorf("got %d %q, want 200 pong", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	handler := maxURLLengthMiddleware(64)(http.HandlerFunc(pingHandler))
+
+	if got := serve(handler, httptest.NewRequest(http.MethodGet, "/helloworld?q=short", nil)).Code; got != http.StatusOK {
+		t.Errorf("short URL got %d, want 200", got)
+	}
+	long := "/helloworld?q=" + strings.Repeat("a", 64)
+	if got := serve(handler, httptest.NewRequest(http.MethodGet, long, nil)).Code; got != http.StatusRequestURITooLong {
+		t.Errorf("long URL got %d, want 414", got)
+	}
+}
+
+func TestMissingStaticFileIsJSON404(t *testing.T) {
+	handler := newRoutes().handler
+
+	for _, path := range []string{"/ui/js/missing.js", "/no/such/route"} {
+		w := serve(handler, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			t.Fatalf("%s got %d with Content-Type %q, want a JSON 404", path, w.Code, w.Header().Get("Content-Type"))
+		}
+		var response ErrorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil || response.Error != "not found" {
+			t.Fatalf("%s got %q, %v", path, w.Body.String(), err)
+		}
+	}
+}
+
+func TestRecoveryAnswersPanicsWith500(t *testing.T) {
+	handler := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("broken handler")
+	}))
+
+	for accept, contentType := range map[string]string{
+		"text/html,application/xhtml+xml": "text/html",
+		"application/json":                "application/json",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		w := serve(handler, r)
+		if w.Code != http.StatusInternalServerError || !strings.HasPrefix(w.Header().Get("Content-Type"), contentType) {
+			t.Errorf("Accept %s got %d with Content-Type %q, want a 500 in %s", accept, w.Code, w.Header().Get("Content-Type"), contentType)
+		}
+	}
+}
+
+// captureLog sends the log to the returned buffer until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&buffer)
+	t.Cleanup(func() { log.Logger = previous })
+
+	return &buffer
+}
+
+func TestSlowQueriesAreLogged(t *testing.T) {
+	openTestDB(t)
+	c := config
+	// Every query is slower than that
+	c.SlowQuery = time.Nanosecond
+	withConfig(t, c)
+	logged := captureLog(t)
+
+	var n int
+	err := queryRowContext(context.Background(), "select count(*) from helloworld").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "Slow query") || !strings.Contains(logged.String(), "select count(*) from helloworld") {
+		t.Fatalf("expected a slow query warning, got %q", logged.String())
+	}
+
+	logged.Reset()
+	config.SlowQuery = 0
+	err = queryRowContext(context.Background(), "select count(*) from helloworld").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logged.String(), "Slow query") {
+		t.Fatalf("-slow-query 0 still logged %q", logged.String())
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	db := openTestDB(t)
+	_, err := db.Exec("create table tx(n integer)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(tx *sql.Tx) error {
+		_, err := tx.Exec("insert into tx(n) values(1)")
+		return err
+	}
+
+	err = withTx(context.Background(), db, insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, db, "tx"); count != 1 {
+		t.Fatalf("got %d rows after a commit, want 1", count)
+	}
+
+	failure := errors.New("failed")
+	err = withTx(context.Background(), db, func(tx *sql.Tx) error {
+		insert(tx)
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("got %v, want the error of fn", err)
+	}
+	if count := countRows(t, db, "tx"); count != 1 {
+		t.Fatalf("got %d rows after an error, want the insert rolled back", count)
+	}
+
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != "broken" {
+				t.Fatalf("got panic %v, want it passed on", recovered)
+			}
+		}()
+		withTx(context.Background(), db, func(tx *sql.Tx) error {
+			insert(tx)
+			panic("broken")
+		})
+	}()
+	if count := countRows(t, db, "tx"); count != 1 {
+		t.Fatalf("got %d rows after a panic, want the insert rolled back", count)
+	}
+}
+
+func TestLogClientHeaders(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		c := config
+		c.LogClientHeaders = enabled
+		withConfig(t, c)
+		logged := captureLog(t)
+
+		r := httptest.NewRequest(http.MethodGet, "/helloworld", nil)
+		r.Header.Set("User-Agent", "test-agent")
+		r.Header.Set("Referer", "http://example.com/from")
+		serve(loggingMiddleware(http.HandlerFunc(pingHandler)), r)
+
+		line := logged.String()
+		if strings.Contains(line, `"user_agent":"test-agent"`) != enabled || strings.Contains(line, `"referer":"http://example.com/from"`) != enabled {
+			t.Errorf("with -log-client-headers=%v the request log was %q", enabled, line)
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	c := config
+	c.LogSampleRate = 3
+	c.LogExcludePaths = nil
+	withConfig(t, c)
+	logged := captureLog(t)
+
+	ok := loggingMiddleware(http.HandlerFunc(pingHandler))
+	failing := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	for i := 0; i < 9; i++ {
+		serve(ok, httptest.NewRequest(http.MethodGet, "/helloworld", nil))
+	}
+	for i := 0; i < 3; i++ {
+		serve(failing, httptest.NewRequest(http.MethodGet, "/fails", nil))
+	}
+
+	if got := strings.Count(logged.String(), `"status":200`); got != 3 {
+		t.Errorf("logged %d of 9 successful requests, want 3", got)
+	}
+	if got := strings.Count(logged.String(), `"status":500`); got != 3 {
+		t.Errorf("logged %d of 3 failed requests, want all of them", got)
+	}
+}
+
+func TestVersionedAssets(t *testing.T) {
+	handler := newRoutes().handler
+
+	for version, color := range map[string]string{"v1": "antiquewhite", "v2": "floralwhite"} {
+		w := serve(handler, httptest.NewRequest(http.MethodGet, "/assets/"+version+"/css/app.css", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), color) {
+			t.Errorf("/assets/%s/css/app.css got %d %q", version, w.Code, w.Body.String())
+		}
+	}
+
+	if status := serve(handler, httptest.NewRequest(http.MethodGet, "/assets/v3/css/app.css", nil)).Code; status != http.StatusNotFound {
+		t.Errorf("unknown asset version got %d, want 404", status)
+	}
+}
+
+func TestWritesNeedJSONContentType(t *testing.T) {
+	withAdminConfig(t)
+	openTestDB(t)
+	withEventBus(t)
+	handler := newRoutes().handler
+
+	for contentType, status := range map[string]int{
+		"text/plain":                      http.StatusUnsupportedMediaType,
+		"application/json; charset=utf-8": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/admin/flags/new-greeting", strings.NewReader(`{"enabled":true}`))
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		r.Header.Set("Content-Type", contentType)
+		if w := serve(handler, r); w.Code != status {
+			t.Errorf("%s body got %d %s, want %d", contentType, w.Code, w.Body.String(), status)
+		}
+	}
+}
+
+func TestReadyzWhenTheDatabaseIsBehind(t *testing.T) {
+	c := config
+	c.SQLDir = copySQLDir(t)
+	withConfig(t, c)
+	db := openTestDB(t)
+
+	current, err := getCurrentDBVersion(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newRoutes().handler
+	if w := serve(handler, httptest.NewRequest(http.MethodGet, "/readyz", nil)); w.Code != http.StatusOK {
+		t.Fatalf("migrated database got %d %s, want 200", w.Code, w.Body.String())
+	}
+
+	next := strconv.FormatInt(current+1, 10)
+	err = os.WriteFile(filepath.Join(config.SQLDir, "v"+next+".sql"), []byte("insert into version (version) values("+next+");"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handler, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", w.Code)
+	}
+	var readiness Readiness
+	err = json.Unmarshal(w.Body.Bytes(), &readiness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readiness.DatabaseVersion != current || readiness.ExpectedVersion != current+1 {
+		t.Fatalf("got versions %d and %d, want %d and %d", readiness.DatabaseVersion, readiness.ExpectedVersion, current, current+1)
+	}
+}
+
+func TestUptimeIncreases(t *testing.T) {
+	previous := serverStarted
+	serverStarted = time.Now()
+	t.Cleanup(func() { serverStarted = previous })
+	handler := newRoutes().handler
+
+	uptime := func() Uptime {
+		w := serve(handler, httptest.NewRequest(http.MethodGet, "/uptime", nil))
+		var uptime Uptime
+		err := json.Unmarshal(w.Body.Bytes(), &uptime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uptime
+	}
+
+	first := uptime()
+	time.Sleep(1100 * time.Millisecond)
+	second := uptime()
+
+	if second.Seconds <= first.Seconds {
+		t.Fatalf("uptime went from %d to %d seconds", first.Seconds, second.Seconds)
+	}
+	if first.StartTime != serverStarted.UTC().Format(time.RFC3339) || second.StartTime != first.StartTime {
+		t.Fatalf("got start times %q and %q", first.StartTime, second.StartTime)
+	}
+}
+
+func TestServesInjectedUIFiles(t *testing.T) {
+	previous := uiSource
+	uiSource = fstest.MapFS{"injected.txt": {Data: []byte("from a MapFS")}}
+	t.Cleanup(func() { uiSource = previous })
+
+	w := serve(newRoutes().handler, httptest.NewRequest(http.MethodGet, "/ui/injected.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "from a MapFS" {
+		t.Fatalf("got %d %q, want the injected file", w.Code, w.Body.String())
+	}
+}
+
+func TestMethodNotAllowedListsAllowedMethods(t *testing.T) {
+	w := serve(newRoutes().handler, httptest.NewRequest(http.MethodPost, "/helloworld", nil))
+
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Fatalf("got %d with Allow %q, want 405 with Allow GET", w.Code, w.Header().Get("Allow"))
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("got Content-Type %q, want JSON", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestStartupFailsWithoutRequiredFiles(t *testing.T) {
+	previous := uiSource
+	uiSource = fstest.MapFS{
+		"pages/helloworld.html": {Data: []byte("<p>{{.Greeting}}</p>")},
+		"errors/500.html":       {Data: []byte("<p>error</p>")},
+	}
+	t.Cleanup(func() { uiSource = previous })
+
+	err := startup()
+	if err == nil || !strings.Contains(err.Error(), "index.html") {
+		t.Fatalf("got %v, want startup to fail naming index.html", err)
+	}
+}
+
+func TestLogExcludePaths(t *testing.T) {
+	c := config
+	c.LogSampleRate = 1
+	c.LogExcludePaths = []string{"/health", "/metrics"}
+	withConfig(t, c)
+	logged := captureLog(t)
+
+	status := http.StatusOK
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/health", nil))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/helloworld", nil))
+	if strings.Contains(logged.String(), `\"/health\"`) {
+		t.Errorf("/health was logged: %s", logged.String())
+	}
+	if !strings.Contains(logged.String(), `\"/helloworld\"`) {
+		t.Errorf("/helloworld wasn't logged: %s", logged.String())
+	}
+
+	// Failures are logged on excluded paths too
+	status = http.StatusServiceUnavailable
+	serve(handler, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if !strings.Contains(logged.String(), `\"/health\"`) {
+		t.Errorf("failed /health wasn't logged: %s", logged.String())
+	}
+}
+
+// Run with -race to check the handle is swapped safely
+func TestSwapDBWithConcurrentReaders(t *testing.T) {
+	first := openTestDB(t)
+	second := openTestDB(t)
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, err := getCurrentDBVersion(context.Background(), getDB())
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			swapDB(first)
+		} else {
+			swapDB(second)
+		}
+	}
+	close(stop)
+	readers.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		c := config
+		c.ResponseEnvelope = enabled
+		withConfig(t, c)
+
+		success := httptest.NewRecorder()
+		writeJSON(success, http.StatusOK, Version{Version: 3})
+		failure := httptest.NewRecorder()
+		writeError(failure, http.StatusBadRequest, "bad request")
+
+		want := map[bool][2]string{
+			true:  {`{"data":{"version":3},"error":null}`, `{"data":null,"error":"bad request"}`},
+			false: {`{"version":3}`, `{"error":"bad request"}`},
+		}[enabled]
+		if got := strings.TrimSpace(success.Body.String()); got != want[0] {
+			t.Errorf("with -envelope=%v success got %s, want %s", enabled, got, want[0])
+		}
+		if got := strings.TrimSpace(failure.Body.String()); got != want[1] || failure.Code != http.StatusBadRequest {
+			t.Errorf("with -envelope=%v error got %d %s, want 400 %s", enabled, failure.Code, got, want[1])
+		}
+	}
+}
+
+func TestGetCurrentDBVersionWithCanceledContext(t *testing.T) {
+	db := openTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	_, err := getCurrentDBVersion(ctx, db)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %s to give up", elapsed)
+	}
+}
+
+func TestMaxPathSegments(t *testing.T) {
+	handler := maxPathSegmentsMiddleware(4)(http.HandlerFunc(pingHandler))
+
+	for path, status := range map[string]int{
+		"/":                             http.StatusOK,
+		"/hellovars/a/b":                http.StatusOK,
+		"/a/b/c/d/":                     http.StatusOK,
+		"/a/b/c/d/e":                    http.StatusBadRequest,
+		"/" + strings.Repeat("a/", 500): http.StatusBadRequest,
+	} {
+		if w := serve(handler, httptest.NewRequest(http.MethodGet, path, nil)); w.Code != status {
+			t.Errorf("%.20s got %d, want %d", path, w.Code, status)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	handler := allowedHostsMiddleware([]string{"example.com", "*.example.org"})(http.HandlerFunc(pingHandler))
+
+	for host, status := range map[string]int{
+		"example.com":      http.StatusOK,
+		"example.com:8081": http.StatusOK,
+		"api.example.org":  http.StatusOK,
+		"evil.example":     http.StatusBadRequest,
+		"example.com.evil": http.StatusBadRequest,
+		"example.org":      http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/helloworld", nil)
+		r.Host = host
+		if w := serve(handler, r); w.Code != status {
+			t.Errorf("host %s got %d, want %d", host, w.Code, status)
+		}
+	}
+
+	// Health checks come from load balancers that don't send the public host
+	r := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	r.Host = "10.0.0.1"
+	if w := serve(handler, r); w.Code != http.StatusOK {
+		t.Errorf("/ping got %d, want 200", w.Code)
+	}
+
+	// An empty list turns the check off
+	r = httptest.NewRequest(http.MethodGet, "/helloworld", nil)
+	r.Host = "evil.example"
+	if w := serve(allowedHostsMiddleware(nil)(http.HandlerFunc(pingHandler)), r); w.Code != http.StatusOK {
+		t.Errorf("without allowed hosts got %d, want 200", w.Code)
+	}
+}
+
+// flakyDriver is the sqlite driver with statements that fail with the queued errors first.
+type flakyDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+// flakyErrors are returned by the next statements run through flakyDriver, one each.
+var flakyErrors struct {
+	sync.Mutex
+	queue []error
+}
+
+func init() {
+	sql.Register("sqlite3-flaky", &flakyDriver{})
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flakyConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type flakyConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *flakyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	flakyErrors.Lock()
+	defer flakyErrors.Unlock()
+
+	if len(flakyErrors.queue) > 0 {
+		err := flakyErrors.queue[0]
+		flakyErrors.queue = flakyErrors.queue[1:]
+		return nil, err
+	}
+
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func TestMigrationRetriesTransientErrors(t *testing.T) {
+	c := config
+	c.MigrationRetries = 2
+	c.MigrationRetryBackoff = time.Millisecond
+	withConfig(t, c)
+
+	for _, test := range []struct {
+		err     error
+		succeed bool
+	}{
+		{sqlite3.Error{Code: sqlite3.ErrIoErr}, true},
+		{sqlite3.Error{Code: sqlite3.ErrError}, false},
+	} {
+		db, err := sql.Open("sqlite3-flaky", dataSourceName(filepath.Join(t.TempDir(), appName+".db")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		flakyErrors.Lock()
+		flakyErrors.queue = []error{test.err}
+		flakyErrors.Unlock()
+
+		version, err := migrateDatabase(context.Background(), db)
+		if test.succeed && (err != nil || version != latestMigrationVersion()) {
+			t.Errorf("%v: got version %d and %v, want the retry to migrate the database", test.err, version, err)
+		}
+		if !test.succeed && !errors.Is(err, test.err) {
+			t.Errorf("%v: got version %d and %v, want the error without a retry", test.err, version, err)
+		}
+	}
+}
+
+func TestDiagnosticsFollowsTheDatabase(t *testing.T) {
+	c := config
+	c.ResponseEnvelope = false
+	withConfig(t, c)
+	db := openTestDB(t)
+	handler := newRoutes().handler
+
+	diagnostics := func(want int) Diagnostics {
+		w := serve(handler, httptest.NewRequest(http.MethodGet, "/diagnostics", nil))
+		if w.Code != want {
+			t.Fatalf("got %d, want %d", w.Code, want)
+		}
+		var sections map[string]json.RawMessage
+		err := json.Unmarshal(w.Body.Bytes(), &sections)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, section := range []string{"status", "database", "build", "uptime"} {
+			if _, ok := sections[section]; !ok {
+				t.Errorf("no %s section in %s", section, w.Body.String())
+			}
+		}
+
+		var diagnostics Diagnostics
+		err = json.Unmarshal(w.Body.Bytes(), &diagnostics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diagnostics
+	}
+
+	up := diagnostics(http.StatusOK)
+	if up.Status != "ok" || up.Database.DatabaseVersion != latestMigrationVersion() || up.Build.GoVersion == "" || up.Uptime.StartTime == "" {
+		t.Errorf("got %+v with the database up", up)
+	}
+
+	db.Close()
+	down := diagnostics(http.StatusServiceUnavailable)
+	if down.Status != "unavailable" || down.Database.DatabaseVersion != -1 || down.Build.GoVersion == "" || down.Uptime.StartTime == "" {
+		t.Errorf("got %+v with the database down", down)
+	}
+}
+
+func TestValidateMigrations(t *testing.T) {
+	c := config
+	c.SQLDir = copySQLDir(t)
+	withConfig(t, c)
+
+	var out bytes.Buffer
+	if !validateMigrations(&out) {
+		t.Fatalf("the embedded migrations failed:\n%s", out.String())
+	}
+
+	broken := "v" + strconv.FormatInt(latestMigrationVersion()+1, 10) + ".sql"
+	err := os.WriteFile(filepath.Join(config.SQLDir, broken), []byte("create tabel broken(id integer);"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if validateMigrations(&out) {
+		t.Fatalf("a broken migration passed:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "FAIL "+broken) {
+		t.Fatalf("output doesn't name %s:\n%s", broken, out.String())
+	}
+}
+
+func TestDisabledMethods(t *testing.T) {
+	openTestDB(t)
+	withEventBus(t)
+	withAdminConfig(t)
+	config.DisabledMethods = []string{"post", "PUT", "DELETE"}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/helloworld", nil),
+		adminRequest(http.MethodPost, "/admin/migrate"),
+		adminJSONRequest(http.MethodPut, "/admin/flags/new-greeting", `{"enabled":true}`),
+		adminRequest(http.MethodDelete, "/admin/flags/new-greeting"),
+	} {
+		w := serve(newRoutes().handler, r)
+		if w.Code != http.StatusMethodNotAllowed || !strings.Contains(w.Body.String(), "disabled") {
+			t.Errorf("got %d %s for %s %s, want a 405 for the disabled method", w.Code, w.Body.String(), r.Method, r.URL.Path)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD, PATCH, OPTIONS" {
+			t.Errorf("got Allow %q for %s %s", allow, r.Method, r.URL.Path)
+		}
+	}
+
+	w := serve(newRoutes().handler, httptest.NewRequest(http.MethodGet, "/helloworld", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s for GET, want 200", w.Code, w.Body.String())
+	}
+
+	config.MethodExemptPaths = []string{"/admin/flags"}
+	w = serve(newRoutes().handler, adminJSONRequest(http.MethodPut, "/admin/flags/new-greeting", `{"enabled":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s on an exempt path, want 200", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Metrics
+// *********************************************************
+
+// unmatchedRoute labels requests no route matched, so unknown paths can't add a series each.
+const unmatchedRoute = "unmatched"
+
+// requestMetrics counts requests by method, route template and status, e.g. /hellovars/{var1}/{var2} rather than
+// /hellovars/a/b.
+var requestMetrics = newMetrics()
+
+type metricKey struct {
+	method string
+	route  string
+	status int
+}
+
+// responseBytesBuckets are the upper bounds of the http_response_bytes histogram buckets.
+var responseBytesBuckets = [...]int64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+type metricValues struct {
+	count    uint64
+	duration time.Duration
+	bytes    int64
+	// bytesBuckets counts the responses of at most responseBytesBuckets[i] bytes, not cumulative.
+	bytesBuckets [len(responseBytesBuckets)]uint64
+}
+
+type metrics struct {
+	mutex  sync.Mutex
+	series map[metricKey]*metricValues
+}
+
+func newMetrics() *metrics {
+	return &metrics{series: make(map[metricKey]*metricValues)}
+}
+
+func (m *metrics) observe(key metricKey, duration time.Duration, bytes int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	values, ok := m.series[key]
+	if !ok {
+		values = &metricValues{}
+		m.series[key] = values
+	}
+	values.count++
+	values.duration += duration
+	values.bytes += bytes
+	for i, bound := range responseBytesBuckets {
+		if bytes <= bound {
+			values.bytesBuckets[i]++
+			break
+		}
+	}
+}
+
+// routeTemplate is filled in by routeTemplateMiddleware once the router has matched the request.
+type routeTemplate struct {
+	template string
+}
+
+type routeTemplateContextKey struct{}
+
+// metricsMiddleware records every request. It runs before routing, so it hands routeTemplateMiddleware a place to
+// put the matched route in.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := &routeTemplate{template: unmatchedRoute}
+		r = r.WithContext(context.WithValue(r.Context(), routeTemplateContextKey{}, route))
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+
+		requestMetrics.observe(metricKey{method: metricMethod(r.Method), route: route.template, status: recorder.Status()}, time.Since(start), recorder.Bytes())
+	})
+}
+
+// metricMethod keeps made up methods from adding series.
+func metricMethod(method string) string {
+	for _, known := range routeMethods {
+		if method == known {
+			return method
+		}
+	}
+
+	return "OTHER"
+}
+
+// routeTemplateMiddleware runs after routing, mux only calls it for requests that matched a route.
+func routeTemplateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := r.Context().Value(routeTemplateContextKey{}).(*routeTemplate)
+		if ok {
+			if current := mux.CurrentRoute(r); current != nil {
+				template, err := current.GetPathTemplate()
+				if err == nil {
+					route.template = template
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsHandler writes the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	requestMetrics.mutex.Lock()
+	keys := make([]metricKey, 0, len(requestMetrics.series))
+	values := make(map[metricKey]metricValues, len(requestMetrics.series))
+	for key, value := range requestMetrics.series {
+		keys = append(keys, key)
+		values[key] = *value
+	}
+	requestMetrics.mutex.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	var builder strings.Builder
+	builder.WriteString("# HELP http_requests_total Requests handled, by method, route template and status.\n")
+	builder.WriteString("# TYPE http_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&builder, "http_requests_total{%s} %d\n", key.labels(), values[key].count)
+	}
+	builder.WriteString("# HELP http_request_duration_seconds Time spent handling requests, by method, route template and status.\n")
+	builder.WriteString("# TYPE http_request_duration_seconds summary\n")
+	for _, key := range keys {
+		fmt.Fprintf(&builder, "http_request_duration_seconds_sum{%s} %s\n", key.labels(), strconv.FormatFloat(values[key].duration.Seconds(), 'f', -1, 64))
+		fmt.Fprintf(&builder, "http_request_duration_seconds_count{%s} %d\n", key.labels(), values[key].count)
+	}
+	builder.WriteString("# HELP http_response_bytes Size of response bodies as sent, by method, route template and status.\n")
+	builder.WriteString("# TYPE http_response_bytes histogram\n")
+	for _, key := range keys {
+		var cumulative uint64
+		for i, bound := range responseBytesBuckets {
+			cumulative += values[key].bytesBuckets[i]
+			fmt.Fprintf(&builder, "http_response_bytes_bucket{%s,le=\"%d\"} %d\n", key.labels(), bound, cumulative)
+		}
+		fmt.Fprintf(&builder, "http_response_bytes_bucket{%s,le=\"+Inf\"} %d\n", key.labels(), values[key].count)
+		fmt.Fprintf(&builder, "http_response_bytes_sum{%s} %d\n", key.labels(), values[key].bytes)
+		fmt.Fprintf(&builder, "http_response_bytes_count{%s} %d\n", key.labels(), values[key].count)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(builder.String()))
+}
+
+func (k metricKey) labels() string {
+	return `method="` + escapeLabel(k.method) + `",route="` + escapeLabel(k.route) + `",status="` + strconv.Itoa(k.status) + `"`
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withMetrics starts the test with no recorded requests.
+func withMetrics(t *testing.T) {
+	t.Helper()
+
+	previous := requestMetrics
+	requestMetrics = newMetrics()
+	t.Cleanup(func() { requestMetrics = previous })
+}
+
+func TestMetricsLabelRouteTemplate(t *testing.T) {
+	withAdminConfig(t)
+	withMetrics(t)
+	handler := newRoutes().handler
+
+	serve(handler, httptest.NewRequest(http.MethodGet, "/hellovars/alice/bob", nil))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/no/such/route", nil))
+	body := serve(handler, adminRequest(http.MethodGet, "/metrics")).Body.String()
+
+	if !strings.Contains(body, `http_requests_total{method="GET",route="/hellovars/{var1}/{var2}",status="200"} 1`) {
+		t.Errorf("no series for the route template:\n%s", body)
+	}
+	if !strings.Contains(body, `route="unmatched",status="404"`) {
+		t.Errorf("no series for the unmatched request:\n%s", body)
+	}
+	for _, concrete := range []string{"alice", "/no/such/route"} {
+		if strings.Contains(body, concrete) {
+			t.Errorf("metrics have the concrete path %q:\n%s", concrete, body)
+		}
+	}
+}
+
+func TestResponseBytesAreRecorded(t *testing.T) {
+	withMetrics(t)
+	logged := captureLog(t)
+
+	body := strings.Repeat("x", 1500)
+	handler := loggingMiddleware(metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Written in two parts, both are counted
+		w.Write([]byte(body[:1000]))
+		w.Write([]byte(body[1000:]))
+	})))
+	w := serve(handler, httptest.NewRequest(http.MethodGet, "/helloworld", nil))
+	if w.Body.Len() != len(body) {
+		t.Fatalf("got a %d byte body", w.Body.Len())
+	}
+
+	values := requestMetrics.series[metricKey{method: http.MethodGet, route: unmatchedRoute, status: http.StatusOK}]
+	if values == nil || values.bytes != int64(len(body)) {
+		t.Fatalf("got metric values %+v, want %d bytes", values, len(body))
+	}
+	// 1500 bytes fall in the le="10000" bucket
+	if values.bytesBuckets[2] != 1 {
+		t.Errorf("got buckets %v", values.bytesBuckets)
+	}
+	if !strings.Contains(logged.String(), `"bytes":1500`) {
+		t.Errorf("request log doesn't have the byte count: %s", logged.String())
+	}
+}
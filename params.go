@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// *********************************************************
+// Query parameters
+// *********************************************************
+
+// intParam reads an integer query parameter. When it is missing or not a number def is returned, and values outside
+// min..max are clamped to the nearest bound.
+func intParam(r *http.Request, name string, def, min, max int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		return def
+	}
+
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+
+	return value
+}
+
+// strictIntParam is intParam for endpoints that should tell the client about a bad value: it returns an error for
+// values that aren't numbers or are outside min..max. def is only used when the parameter is missing.
+func strictIntParam(r *http.Request, name string, def, min, max int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return def, fmt.Errorf("%s must be a whole number", name)
+	}
+	if value < min || value > max {
+		return def, fmt.Errorf("%s must be between %d and %d", name, min, max)
+	}
+
+	return value, nil
+}
+
+// sortParam turns ?sort=name,-enabled into an ORDER BY list, "-" sorts descending. Only the fields in columns can be
+// used, mapped to their column, so the value never reaches the SQL as is. def is used when the parameter is missing.
+func sortParam(r *http.Request, columns map[string]string, def string) (string, error) {
+	raw := r.URL.Query().Get("sort")
+	if raw == "" {
+		return def, nil
+	}
+
+	var clauses []string
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		direction := "asc"
+		if strings.HasPrefix(field, "-") {
+			field = field[1:]
+			direction = "desc"
+		}
+
+		column, ok := columns[field]
+		if !ok {
+			return def, fmt.Errorf("can't sort by %q, use one of: %s", field, strings.Join(sortedKeys(columns), ", "))
+		}
+		clauses = append(clauses, column+" "+direction)
+	}
+
+	return strings.Join(clauses, ", "), nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// PageSize is the default and the largest number of items a list endpoint returns at once.
+type PageSize struct {
+	Default int
+	Max     int
+}
+
+// defaultPageSize is used for resources without their own page size.
+var defaultPageSize = PageSize{Default: 50, Max: 200}
+
+// pageSizes holds the page size of each resource, see registerPageSize and -page-sizes.
+var pageSizes = map[string]PageSize{
+	"flags": {Default: 100, Max: 500},
+}
+
+// registerPageSize sets the page size of a resource. -page-sizes overrides it.
+func registerPageSize(resource string, size PageSize) {
+	pageSizes[resource] = size
+}
+
+// parsePageSizes reads "resource=default:max" values, e.g. "flags=20:100".
+func parsePageSizes(values []string) error {
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("page size %q must look like resource=default:max", value)
+		}
+
+		sizes := strings.SplitN(parts[1], ":", 2)
+		def, err := strconv.Atoi(sizes[0])
+		if err != nil || len(sizes) != 2 {
+			return fmt.Errorf("page size %q must look like resource=default:max", value)
+		}
+		max, err := strconv.Atoi(sizes[1])
+		if err != nil || def < 1 || max < def {
+			return fmt.Errorf("page size %q needs 1 <= default <= max", value)
+		}
+		registerPageSize(parts[0], PageSize{Default: def, Max: max})
+	}
+
+	return nil
+}
+
+// Page is the part of a list a request asked for.
+type Page struct {
+	Offset int
+	Limit  int
+}
+
+// pageParam reads ?offset= and ?limit= using the page size of the resource. A limit above the max is lowered to it.
+func pageParam(r *http.Request, resource string) (Page, error) {
+	size, ok := pageSizes[resource]
+	if !ok {
+		size = defaultPageSize
+	}
+
+	offset, err := strictIntParam(r, "offset", 0, 0, math.MaxInt32)
+	if err != nil {
+		return Page{}, err
+	}
+
+	return Page{Offset: offset, Limit: intParam(r, "limit", size.Default, 1, size.Max)}, nil
+}
+
+// PageResponse is a page of a list with the total number of items and links to the pages around it. Next and Prev
+// are left out on the last and first page.
+type PageResponse struct {
+	Items interface{} `json:"items"`
+	Total int         `json:"total"`
+	Next  string      `json:"next,omitempty"`
+	Prev  string      `json:"prev,omitempty"`
+}
+
+// newPageResponse links the pages before and after page, out of total items, with absolute URLs based on the request.
+func newPageResponse(r *http.Request, items interface{}, page Page, total int) PageResponse {
+	response := PageResponse{Items: items, Total: total}
+	if page.Offset+page.Limit < total {
+		response.Next = pageURL(r, page.Offset+page.Limit, page.Limit)
+	}
+	if page.Offset > 0 {
+		prev := page.Offset - page.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		response.Prev = pageURL(r, prev, page.Limit)
+	}
+
+	return response
+}
+
+// pageURL is the request URL with ?offset= and ?limit= replaced, other query parameters are kept.
+func pageURL(r *http.Request, offset, limit int) string {
+	query := r.URL.Query()
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(limit))
+
+	link := externalURL(r)
+	link.Path += r.URL.Path
+	link.RawQuery = query.Encode()
+
+	return link.String()
+}
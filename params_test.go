@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIntParam(t *testing.T) {
+	for query, want := range map[string]int{
+		"":           10,
+		"?limit=25":  25,
+		"?limit=0":   1,
+		"?limit=500": 100,
+		"?limit=abc": 10,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/"+query, nil)
+		if got := intParam(r, "limit", 10, 1, 100); got != want {
+			t.Errorf("%q got %d, want %d", query, got, want)
+		}
+	}
+}
+
+func TestStrictIntParam(t *testing.T) {
+	for query, want := range map[string]struct {
+		value int
+		ok    bool
+	}{
+		"":           {10, true},
+		"?limit=25":  {25, true},
+		"?limit=0":   {10, false},
+		"?limit=500": {10, false},
+		"?limit=abc": {10, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/"+query, nil)
+		value, err := strictIntParam(r, "limit", 10, 1, 100)
+		if value != want.value || (err == nil) != want.ok {
+			t.Errorf("%q got %d, %v", query, value, err)
+		}
+	}
+}
+
+func TestSortParam(t *testing.T) {
+	for query, want := range map[string]string{
+		"":                       "name asc",
+		"?sort=enabled":          "enabled asc",
+		"?sort=-enabled":         "enabled desc",
+		"?sort=-enabled,name":    "enabled desc, name asc",
+		"?sort=name,%20-enabled": "name asc, enabled desc",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/flags"+query, nil)
+		got, err := sortParam(r, flagSortColumns, "name asc")
+		if err != nil || got != want {
+			t.Errorf("%q got %q %v, want %q", query, got, err, want)
+		}
+	}
+
+	for _, query := range []string{"?sort=password", "?sort=name%3Bdrop%20table%20feature_flags", "?sort=-"} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/flags"+query, nil)
+		if _, err := sortParam(r, flagSortColumns, "name asc"); err == nil {
+			t.Errorf("%q was accepted", query)
+		}
+	}
+}
+
+func TestListFlagsRejectsUnknownSortField(t *testing.T) {
+	withAdminConfig(t)
+	openTestDB(t)
+
+	if w := serve(newRoutes().handler, adminRequest(http.MethodGet, "/admin/flags?sort=password")); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want 400", w.Code, w.Body.String())
+	}
+}
+
+// withPageSizes lets the test register page sizes without changing the ones other tests see.
+func withPageSizes(t *testing.T) {
+	t.Helper()
+
+	previous := pageSizes
+	pageSizes = make(map[string]PageSize, len(previous))
+	for resource, size := range previous {
+		pageSizes[resource] = size
+	}
+	t.Cleanup(func() { pageSizes = previous })
+}
+
+func TestPageSizePerResource(t *testing.T) {
+	withPageSizes(t)
+
+	page := func(resource, query string) Page {
+		page, err := pageParam(httptest.NewRequest(http.MethodGet, "/"+query, nil), resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	if got := page("flags", "?limit=10000").Limit; got != 500 {
+		t.Errorf("flags got limit %d, want its max 500", got)
+	}
+	if got := page("flags", "").Limit; got != 100 {
+		t.Errorf("flags got limit %d, want its default 100", got)
+	}
+	if got := page("unknown", "?limit=10000").Limit; got != defaultPageSize.Max {
+		t.Errorf("unknown resource got limit %d, want %d", got, defaultPageSize.Max)
+	}
+
+	err := parsePageSizes([]string{"flags=20:100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := page("flags", "?limit=10000").Limit; got != 100 {
+		t.Errorf("flags got limit %d after -page-sizes, want 100", got)
+	}
+
+	for _, value := range []string{"flags", "flags=20", "flags=0:10", "flags=20:10"} {
+		if parsePageSizes([]string{value}) == nil {
+			t.Errorf("%q was accepted", value)
+		}
+	}
+}
+
+func TestPageResponseLinks(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/admin/flags?sort=name&limit=10", nil)
+
+	for _, test := range []struct {
+		offset     int
+		next, prev string
+	}{
+		{0, "http://example.com/admin/flags?limit=10&offset=10&sort=name", ""},
+		{10, "http://example.com/admin/flags?limit=10&offset=20&sort=name", "http://example.com/admin/flags?limit=10&offset=0&sort=name"},
+		{20, "", "http://example.com/admin/flags?limit=10&offset=10&sort=name"},
+	} {
+		response := newPageResponse(r, nil, Page{Offset: test.offset, Limit: 10}, 25)
+		if response.Next != test.next || response.Prev != test.prev {
+			t.Errorf("offset %d got next %q and prev %q, want %q and %q", test.offset, response.Next, response.Prev, test.next, test.prev)
+		}
+	}
+}
+
+func TestPageResponseLinksBehindProxy(t *testing.T) {
+	withTrustedProxies(t, "192.0.2.0/24")
+	r := httptest.NewRequest(http.MethodGet, "/admin/flags?limit=10", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "api.example.com")
+	r.Header.Set("X-Forwarded-Prefix", "/app/")
+
+	response := newPageResponse(r, nil, Page{Offset: 0, Limit: 10}, 25)
+	if want := "https://api.example.com/app/admin/flags?limit=10&offset=10"; response.Next != want {
+		t.Fatalf("got next %q, want %q", response.Next, want)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// *********************************************************
+// Reverse proxy support
+// *********************************************************
+
+// trustedProxyNets is parsed from -trusted-proxies by validateConfig.
+var trustedProxyNets []*net.IPNet
+
+// parseTrustedProxies accepts IP addresses and CIDR ranges, e.g. 10.0.0.1 or 10.0.0.0/8
+func parseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", value)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", value)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// fromTrustedProxy reports whether the request came straight from one of the -trusted-proxies. Only then can the
+// X-Forwarded-* headers be believed.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	return isTrustedProxyIP(ip)
+}
+
+// clientIP returns the address of the client. Behind a trusted proxy that is the last X-Forwarded-For entry the
+// proxies didn't add themselves, earlier entries could have been made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromTrustedProxy(r) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxyIP(ip) {
+			return ip.String()
+		}
+	}
+
+	return host
+}
+
+// externalURL returns the URL the client used to reach the server, without the path. Behind a trusted proxy the
+// X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers replace what the server saw itself.
+func externalURL(r *http.Request) *url.URL {
+	external := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		external.Scheme = "https"
+	}
+	if !fromTrustedProxy(r) {
+		return external
+	}
+
+	proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+	if proto == "http" || proto == "https" {
+		external.Scheme = proto
+	}
+	if host := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0]); host != "" {
+		external.Host = host
+	}
+	external.Path = strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/")
+
+	return external
+}
+
+// secureCookies reports whether cookies set in the response should be Secure: the client used https, directly or
+// through a trusted proxy, or -secure-cookies forces it.
+func secureCookies(r *http.Request) bool {
+	return configFromContext(r.Context()).SecureCookies || externalURL(r).Scheme == "https"
+}
+
+func isTrustedProxyIP(ip net.IP) bool {
+	for _, ipNet := range trustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpsRedirectMiddleware sends clients that reached a TLS terminating proxy over plain http to the https URL.
+// X-Forwarded-Proto is only looked at for requests from a trusted proxy.
+func httpsRedirectMiddleware(enabled bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "http") {
+				http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
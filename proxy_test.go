@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withTrustedProxies sets -trusted-proxies for the test. httptest requests come from 192.0.2.1.
+func withTrustedProxies(t *testing.T, proxies ...string) {
+	t.Helper()
+
+	nets, err := parseTrustedProxies(proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := trustedProxyNets
+	trustedProxyNets = nets
+	t.Cleanup(func() { trustedProxyNets = previous })
+}
+
+func forwardedRequest(proto string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/helloworld?x=1", nil)
+	r.Header.Set("X-Forwarded-Proto", proto)
+	return r
+}
+
+func TestHTTPSRedirectBehindTrustedProxy(t *testing.T) {
+	handler := httpsRedirectMiddleware(true)(http.HandlerFunc(pingHandler))
+
+	withTrustedProxies(t, "192.0.2.0/24")
+	w := serve(handler, forwardedRequest("http"))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://example.com/helloworld?x=1" {
+		t.Fatalf("got %d to %q, want a 301 to the https URL", w.Code, w.Header().Get("Location"))
+	}
+	if got := serve(handler, forwardedRequest("https")).Code; got != http.StatusOK {
+		t.Fatalf("a forwarded https request got %d, want 200", got)
+	}
+
+	// The header of a client that isn't a trusted proxy is ignored
+	withTrustedProxies(t, "10.0.0.1")
+	if got := serve(handler, forwardedRequest("http")).Code; got != http.StatusOK {
+		t.Fatalf("an untrusted X-Forwarded-Proto got %d, want 200", got)
+	}
+}
+
+func TestSecureCookies(t *testing.T) {
+	withTrustedProxies(t, "192.0.2.0/24")
+	c := config
+	c.SecureCookies = false
+	withConfig(t, c)
+	handler := csrfMiddleware(http.HandlerFunc(pingHandler))
+
+	secure := func(r *http.Request) bool {
+		cookies := serve(handler, r).Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("got cookies %v", cookies)
+		}
+		return cookies[0].Secure
+	}
+
+	if !secure(httptest.NewRequest(http.MethodGet, "https://example.com/", nil)) {
+		t.Error("cookie over direct TLS isn't Secure")
+	}
+	if !secure(forwardedRequest("https")) {
+		t.Error("cookie behind a proxy forwarding https isn't Secure")
+	}
+	if secure(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)) {
+		t.Error("cookie over plain http is Secure")
+	}
+
+	withTrustedProxies(t, "10.0.0.1")
+	if secure(forwardedRequest("https")) {
+		t.Error("cookie is Secure because of an untrusted X-Forwarded-Proto")
+	}
+
+	config.SecureCookies = true
+	if !secure(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)) {
+		t.Error("-secure-cookies didn't force Secure")
+	}
+}
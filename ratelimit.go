@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Rate limit
+// *********************************************************
+
+const (
+	rateLimitStoreMemory = "memory"
+	rateLimitStoreSQLite = "sqlite"
+)
+
+// rateLimitStore counts the requests of each client in fixed windows. hit counts one more request for key in the
+// window that starts at windowStart and returns the count so far.
+type rateLimitStore interface {
+	hit(ctx context.Context, key string, windowStart time.Time) (int64, error)
+}
+
+func validateRateLimitStore(store string) error {
+	if store != rateLimitStoreMemory && store != rateLimitStoreSQLite {
+		return fmt.Errorf("unknown rate limit store %q, use %s or %s", store, rateLimitStoreMemory, rateLimitStoreSQLite)
+	}
+
+	return nil
+}
+
+// newRateLimitStore returns the -rate-limit-store backend. The memory store only counts the requests of this
+// process, several processes sharing the database file have to use the sqlite one.
+func newRateLimitStore(store string) rateLimitStore {
+	if store == rateLimitStoreSQLite {
+		return &sqliteRateLimitStore{}
+	}
+
+	return newMemoryRateLimitStore()
+}
+
+// rateLimitMiddleware answers a client's requests with a 429 once it made more than limit of them in the current
+// window. Clients are told apart by clientIP. limit 0 turns it off. Health checks are never limited. A store that
+// fails lets the request through, the limit isn't worth an outage.
+func rateLimitMiddleware(store rateLimitStore, limit int, window time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasPathPrefix(r.URL.Path, alwaysAllowedPaths) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			now := time.Now()
+			windowStart := now.Truncate(window)
+			count, err := store.hit(r.Context(), clientIP(r), windowStart)
+			if err != nil {
+				log.Error().Err(err).Msg("Could not count the request for the rate limit")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			remaining := int64(limit) - count
+			if remaining < 0 {
+				remaining = 0
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+
+			if count > int64(limit) {
+				log.Warn().Str("client", clientIP(r)).Int("limit", limit).Msg("Rate limit exceeded, rejected " + r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(windowStart.Add(window).Sub(now))))
+				writeError(w, http.StatusTooManyRequests, "too many requests, try again later")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type rateLimitWindow struct {
+	start time.Time
+	count int64
+}
+
+// memoryRateLimitStore keeps the counts in a map. Counts of past windows are dropped when the window changes.
+type memoryRateLimitStore struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	counts      map[string]*rateLimitWindow
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{counts: make(map[string]*rateLimitWindow)}
+}
+
+func (s *memoryRateLimitStore) hit(ctx context.Context, key string, windowStart time.Time) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if windowStart.After(s.windowStart) {
+		s.windowStart = windowStart
+		for k, counted := range s.counts {
+			if counted.start.Before(windowStart) {
+				delete(s.counts, k)
+			}
+		}
+	}
+
+	counted, ok := s.counts[key]
+	if !ok || !counted.start.Equal(windowStart) {
+		counted = &rateLimitWindow{start: windowStart}
+		s.counts[key] = counted
+	}
+	counted.count++
+
+	return counted.count, nil
+}
+
+// sqliteRateLimitStore keeps the counts in the rate_limits table, so every process using the database shares them.
+// Each hit is a single upsert, which sqlite runs atomically.
+type sqliteRateLimitStore struct {
+	mutex sync.Mutex
+	// pruned is the window the rows of older windows were last deleted in
+	pruned time.Time
+}
+
+func (s *sqliteRateLimitStore) hit(ctx context.Context, key string, windowStart time.Time) (int64, error) {
+	s.prune(windowStart)
+
+	var count int64
+	err := withLockRetry(func() error {
+		return queryRowContext(ctx, "insert into rate_limits(key, window_start, count) values(?, ?, 1) "+
+			"on conflict(key) do update set count = case when window_start = excluded.window_start then count + 1 else 1 end, window_start = excluded.window_start "+
+			"returning count", key, windowStart.Unix()).Scan(&count)
+	})
+
+	return count, err
+}
+
+// prune deletes the rows of past windows once per window.
+func (s *sqliteRateLimitStore) prune(windowStart time.Time) {
+	s.mutex.Lock()
+	if !windowStart.After(s.pruned) {
+		s.mutex.Unlock()
+		return
+	}
+	s.pruned = windowStart
+	s.mutex.Unlock()
+
+	_, err := execContext(context.Background(), "delete from rate_limits where window_start < ?", windowStart.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not delete old rate limit counts")
+	}
+}
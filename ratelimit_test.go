@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitStoreSharing(t *testing.T) {
+	openTestDB(t)
+
+	for store, shared := range map[string]bool{rateLimitStoreSQLite: true, rateLimitStoreMemory: false} {
+		// Two processes using the same database, each with its own limiter
+		first := rateLimitMiddleware(newRateLimitStore(store), 3, time.Hour)(http.HandlerFunc(pingHandler))
+		second := rateLimitMiddleware(newRateLimitStore(store), 3, time.Hour)(http.HandlerFunc(pingHandler))
+		request := func(handler http.Handler) int {
+			return serve(handler, httptest.NewRequest(http.MethodGet, "/helloworld", nil)).Code
+		}
+
+		for i, handler := range []http.Handler{first, second, first} {
+			if status := request(handler); status != http.StatusOK {
+				t.Fatalf("%s: request %d got %d, want 200", store, i+1, status)
+			}
+		}
+
+		want := http.StatusOK
+		if shared {
+			want = http.StatusTooManyRequests
+		}
+		if status := request(second); status != want {
+			t.Errorf("%s: fourth request on the second limiter got %d, want %d", store, status, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// *********************************************************
+// Content negotiation
+// *********************************************************
+
+// marshaler turns a response payload into the body for one media type.
+type marshaler func(payload interface{}) ([]byte, error)
+
+type responder struct {
+	mediaType string
+	marshal   marshaler
+}
+
+// responders are the media types respond can answer with. The first one is used when the Accept header lists none of
+// them.
+var responders = []responder{
+	{mediaType: "application/json", marshal: marshalJSON},
+	{mediaType: "text/plain", marshal: marshalText},
+	{mediaType: "application/xml", marshal: xml.Marshal},
+}
+
+// registerResponder adds a media type to respond, or replaces the marshaler of one it already has.
+func registerResponder(mediaType string, marshal marshaler) {
+	for i := range responders {
+		if responders[i].mediaType == mediaType {
+			responders[i].marshal = marshal
+			return
+		}
+	}
+
+	responders = append(responders, responder{mediaType: mediaType, marshal: marshal})
+}
+
+// respond sends the payload in the first media type of the Accept header that has a responder, JSON when there is
+// none. JSON goes through writeJSON, so -envelope still applies to it.
+func respond(w http.ResponseWriter, r *http.Request, status int, payload interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	offers := make([]string, 0, len(responders))
+	for _, responder := range responders {
+		offers = append(offers, responder.mediaType)
+	}
+	mediaType := preferredMediaType(r, offers...)
+	if mediaType == "" || mediaType == "application/json" {
+		writeJSON(w, status, payload)
+		return
+	}
+
+	for _, responder := range responders {
+		if responder.mediaType != mediaType {
+			continue
+		}
+
+		body, err := responder.marshal(payload)
+		if err != nil {
+			log.Error().Err(err).Str("media_type", mediaType).Msg("Could not marshal the response")
+			writeError(w, http.StatusInternalServerError, "could not write the response as "+mediaType)
+			return
+		}
+
+		w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+}
+
+func marshalJSON(payload interface{}) ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+// marshalText uses String() when the payload has one. Otherwise it writes a "name: value" line for every JSON field,
+// sorted by name.
+func marshalText(payload interface{}) ([]byte, error) {
+	if stringer, ok := payload.(fmt.Stringer); ok {
+		return []byte(stringer.String() + "\n"), nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) != nil {
+		// Not an object, e.g. a list or a number
+		return append(body, '\n'), nil
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&builder, "%s: %v\n", name, fields[name])
+	}
+
+	return []byte(builder.String()), nil
+}
+
+// charsetMiddleware adds "; charset=utf-8" to text/* and JSON content types that have no charset, for clients that
+// would guess another one. enabled false turns it off.
+func charsetMiddleware(enabled bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&charsetResponseWriter{ResponseWriter: w}, r)
+		})
+	}
+}
+
+type charsetResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (c *charsetResponseWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.Header().Set("Content-Type", withCharset(c.Header().Get("Content-Type")))
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *charsetResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *charsetResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// withCharset returns contentType with charset=utf-8 added when it is text or JSON without a charset.
+func withCharset(contentType string) string {
+	if contentType == "" {
+		return contentType
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] != "" {
+		return contentType
+	}
+	if strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return contentType + "; charset=utf-8"
+	}
+
+	return contentType
+}
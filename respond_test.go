@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRespondFollowsAccept(t *testing.T) {
+	c := config
+	c.ResponseEnvelope = false
+	withConfig(t, c)
+
+	for accept, want := range map[string]struct {
+		contentType string
+		body        string
+	}{
+		"":                                 {"application/json", `{"status":"ok"}`},
+		"application/json":                 {"application/json", `{"status":"ok"}`},
+		"application/xml":                  {"application/xml; charset=utf-8", `<Health><status>ok</status></Health>`},
+		"text/html;q=0.9, application/xml": {"application/xml; charset=utf-8", `<Health><status>ok</status></Health>`},
+		"image/png":                        {"application/json", `{"status":"ok"}`},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/health", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		respond(w, r, http.StatusOK, Health{Status: "ok"})
+
+		if w.Header().Get("Content-Type") != want.contentType || strings.TrimSpace(w.Body.String()) != want.body {
+			t.Errorf("Accept %q got %s %s, want %s %s", accept, w.Header().Get("Content-Type"), w.Body.String(), want.contentType, want.body)
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q got Vary %q", accept, w.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestCharsetMiddleware(t *testing.T) {
+	for contentType, want := range map[string]string{
+		"text/html":                      "text/html; charset=utf-8",
+		"application/json":               "application/json; charset=utf-8",
+		"application/problem+json":       "application/problem+json; charset=utf-8",
+		"text/plain; charset=iso-8859-1": "text/plain; charset=iso-8859-1",
+		"image/png":                      "image/png",
+	} {
+		contentType := contentType
+		handler := charsetMiddleware(true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte("body"))
+		}))
+
+		w := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("got Content-Type %q for %q, want %q", got, contentType, want)
+		}
+	}
+
+	handler := charsetMiddleware(false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	w := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := w.Header().Get("Content-Type"); got != "text/html" {
+		t.Errorf("got Content-Type %q with the middleware disabled, want text/html", got)
+	}
+}
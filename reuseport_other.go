@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "syscall"
+
+const reusePortSupported = false
+
+// reusePortControl is never used on platforms without SO_REUSEPORT, see reusePortSupported.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
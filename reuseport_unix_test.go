@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReusePortLetsTwoListenersBindTheSamePort(t *testing.T) {
+	listenConfig := net.ListenConfig{Control: reusePortControl}
+
+	first, err := listenConfig.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := listenConfig.Listen(context.Background(), "tcp", first.Addr().String())
+	if err != nil {
+		t.Fatalf("a second listener with SO_REUSEPORT could not bind %s: %v", first.Addr(), err)
+	}
+	second.Close()
+
+	// Without it the port is taken
+	plain, err := net.Listen("tcp", first.Addr().String())
+	if err == nil {
+		plain.Close()
+		t.Fatal("expected a listener without SO_REUSEPORT to fail")
+	}
+}
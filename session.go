@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Sessions
+// *********************************************************
+
+// Session holds the values a handler stored for one browser, kept in the sessions table between requests. Get it with
+// sessionFromContext.
+type Session struct {
+	mutex  sync.Mutex
+	w      http.ResponseWriter
+	id     string
+	values map[string]json.RawMessage
+	// cookieSent keeps a request that sets several values from sending the cookie more than once
+	cookieSent bool
+	secure     bool
+}
+
+type sessionContextKey struct{}
+
+// sessionMiddleware loads the session named by the -session-cookie cookie. A request without one, or with an expired
+// one, gets an empty session that is only stored, and sent as a cookie, once a value is set.
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := &Session{w: w, values: map[string]json.RawMessage{}, secure: secureCookies(r)}
+
+		cookie, err := r.Cookie(configFromContext(r.Context()).SessionCookie)
+		if err == nil {
+			values, err := loadSession(r.Context(), cookie.Value)
+			if err == nil {
+				session.id = cookie.Value
+				session.values = values
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				log.Error().Err(err).Msg("Could not load the session")
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sessionFromContext returns the session of the request. Without sessionMiddleware it is an empty session that
+// can't be saved.
+func sessionFromContext(ctx context.Context) *Session {
+	session, ok := ctx.Value(sessionContextKey{}).(*Session)
+	if !ok {
+		return &Session{values: map[string]json.RawMessage{}}
+	}
+
+	return session
+}
+
+// Get decodes the value stored under key into value. It returns false when there is none.
+func (s *Session) Get(key string, value interface{}) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	raw, ok := s.values[key]
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(raw, value)
+}
+
+// Set stores value under key and saves the session right away, which also pushes its expiry back by -session-ttl.
+// It sends the session cookie, so it has to be called before the response is written.
+func (s *Session) Set(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.w == nil {
+		return errors.New("the session can't be saved without sessionMiddleware")
+	}
+	if s.id == "" {
+		s.id, err = randomToken()
+		if err != nil {
+			return err
+		}
+		deleteExpiredSessions()
+	}
+	s.values[key] = raw
+	if !s.cookieSent {
+		// Also sent for existing sessions, so the cookie lives as long as the session
+		s.setCookie()
+		s.cookieSent = true
+	}
+
+	return saveSession(s.id, s.values)
+}
+
+func (s *Session) setCookie() {
+	http.SetCookie(s.w, &http.Cookie{
+		Name:     config.SessionCookie,
+		Value:    s.id,
+		Path:     "/",
+		MaxAge:   int(config.SessionTTL.Seconds()),
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// randomToken returns 256 random bits, so session ids and CSRF tokens can't be guessed.
+func randomToken() (string, error) {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// loadSession returns sql.ErrNoRows for unknown and expired sessions.
+func loadSession(ctx context.Context, id string) (map[string]json.RawMessage, error) {
+	var data string
+	err := queryRowContext(ctx, "select data from sessions where id = ? and expires_at > ?", id, time.Now().Unix()).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]json.RawMessage{}
+	return values, json.Unmarshal([]byte(data), &values)
+}
+
+func saveSession(id string, values map[string]json.RawMessage) error {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	return withLockRetry(func() error {
+		_, err := execContext(context.Background(), "insert into sessions(id, data, expires_at) values(?, ?, ?) on conflict(id) do update set data = excluded.data, expires_at = excluded.expires_at",
+			id, string(data), time.Now().Add(config.SessionTTL).Unix())
+		return err
+	})
+}
+
+// deleteExpiredSessions runs whenever a session is created, so the table doesn't grow without a cleanup job.
+func deleteExpiredSessions() {
+	_, err := execContext(context.Background(), "delete from sessions where expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not delete the expired sessions")
+	}
+}
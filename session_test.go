@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// sessionTestHandler stores ?name= in the session and answers with the name stored in it.
+func sessionTestHandler(t *testing.T) http.Handler {
+	return configMiddleware(sessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContext(r.Context())
+		if name := r.URL.Query().Get("name"); name != "" {
+			err := session.Set("name", name)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		var name string
+		_, err := session.Get("name", &name)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(name))
+	})))
+}
+
+func TestSessionPersistsAcrossRequests(t *testing.T) {
+	db := openTestDB(t)
+	handler := sessionTestHandler(t)
+
+	w := serve(handler, httptest.NewRequest(http.MethodGet, "/?name=anna", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != config.SessionCookie {
+		t.Fatalf("got cookies %v, want the session cookie", cookies)
+	}
+	cookie := cookies[0]
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Secure {
+		t.Errorf("got cookie %v, want HttpOnly and SameSite=Lax, not Secure over http", cookie)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	if w := serve(handler, r); w.Body.String() != "anna" {
+		t.Fatalf("got %q from the session, want anna", w.Body.String())
+	}
+
+	// Reading a session doesn't create one
+	if w := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)); len(w.Result().Cookies()) != 0 {
+		t.Errorf("got a cookie without setting a value")
+	}
+
+	_, err := db.Exec("update sessions set expires_at = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	if w := serve(handler, r); w.Body.String() != "" {
+		t.Fatalf("got %q from an expired session", w.Body.String())
+	}
+
+	// Creating a session deletes the expired ones
+	serve(handler, httptest.NewRequest(http.MethodGet, "/?name=ben", nil))
+	if count := countRows(t, db, "sessions"); count != 1 {
+		t.Fatalf("got %d sessions, want only the new one", count)
+	}
+}
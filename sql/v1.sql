@@ -1,5 +1,3 @@
 create table helloworld(content text);
 
-insert into helloworld(content) values("helloworld");
-
 insert into version (version) values(1);
\ No newline at end of file
@@ -0,0 +1,3 @@
+create table feature_flags(name text primary key, enabled integer not null default 0);
+
+insert into version (version) values(2);
\ No newline at end of file
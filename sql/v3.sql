@@ -0,0 +1,3 @@
+create table audit_log(id integer primary key autoincrement, time text not null, actor text not null, action text not null, target text not null, result text not null, request_id text not null);
+
+insert into version (version) values(3);
\ No newline at end of file
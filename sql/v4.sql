@@ -0,0 +1,5 @@
+create table sessions(id text primary key, data text not null, expires_at integer not null);
+
+create index sessions_expires_at on sessions(expires_at);
+
+insert into version (version) values(4);
\ No newline at end of file
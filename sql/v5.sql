@@ -0,0 +1,3 @@
+create table rate_limits(key text primary key, window_start integer not null, count integer not null);
+
+insert into version (version) values(5);
\ No newline at end of file
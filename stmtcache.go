@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// *********************************************************
+// Prepared statement cache
+// *********************************************************
+
+// statements keeps the prepared statements of the queries run through execContext, queryContext and
+// queryRowContext, so hot queries are only prepared once. Its size is -statement-cache-size.
+var statements = newStatementCache()
+
+// statementCache holds up to maxEntries prepared statements by SQL text, closing the least recently used one when it
+// is full. The statements belong to one *sql.DB, the cache starts over when swapDB replaces it.
+type statementCache struct {
+	mutex   sync.Mutex
+	db      *sql.DB
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedStatement struct {
+	query     string
+	statement *sql.Stmt
+	// users is how many callers got the statement from prepare and haven't released it. An evicted statement is
+	// closed by the last one, closing it under a caller that is about to run it would fail that query.
+	users   int
+	evicted bool
+}
+
+func newStatementCache() *statementCache {
+	return &statementCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// prepare returns the cached statement for the query, preparing it on db when it isn't cached yet. The caller has to
+// call release once it has run the statement. Rows it returned may be read after that.
+func (c *statementCache) prepare(ctx context.Context, db *sql.DB, query string, maxEntries int) (*cachedStatement, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.db != db {
+		c.clear()
+		c.db = db
+	}
+	if element, ok := c.entries[query]; ok {
+		c.order.MoveToFront(element)
+		cached := element.Value.(*cachedStatement)
+		cached.users++
+		return cached, nil
+	}
+
+	// Preparing under the lock keeps two callers from preparing the same query, sqlite prepares quickly
+	statement, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := &cachedStatement{query: query, statement: statement, users: 1}
+	c.entries[query] = c.order.PushFront(cached)
+	for c.order.Len() > maxEntries {
+		c.evict(c.order.Back())
+	}
+
+	return cached, nil
+}
+
+// release hands back a statement from prepare.
+func (c *statementCache) release(cached *cachedStatement) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached.users--
+	if cached.evicted && cached.users == 0 {
+		closeStatement(cached.statement)
+	}
+}
+
+// clear closes every statement, the caller holds the lock.
+func (c *statementCache) clear() {
+	for c.order.Len() > 0 {
+		c.evict(c.order.Back())
+	}
+}
+
+// evict drops the statement from the cache and closes it once no caller uses it. database/sql keeps it open for
+// rows that are still being read.
+func (c *statementCache) evict(element *list.Element) {
+	cached := element.Value.(*cachedStatement)
+	c.order.Remove(element)
+	delete(c.entries, cached.query)
+
+	cached.evicted = true
+	if cached.users == 0 {
+		closeStatement(cached.statement)
+	}
+}
+
+func closeStatement(statement *sql.Stmt) {
+	err := statement.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not close a cached statement")
+	}
+}
+
+// execContext runs the query on the current database with a cached prepared statement, or without one when
+// -statement-cache-size is 0. Queries slower than -slow-query are logged.
+func execContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer logSlowQuery(query, time.Now())
+
+	db := getDB()
+	if config.StatementCacheSize <= 0 {
+		return db.ExecContext(ctx, query, args...)
+	}
+
+	cached, err := statements.prepare(ctx, db, query, config.StatementCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	defer statements.release(cached)
+
+	return cached.statement.ExecContext(ctx, args...)
+}
+
+// queryContext is execContext for queries returning rows.
+func queryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	defer logSlowQuery(query, time.Now())
+
+	db := getDB()
+	if config.StatementCacheSize <= 0 {
+		return db.QueryContext(ctx, query, args...)
+	}
+
+	cached, err := statements.prepare(ctx, db, query, config.StatementCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	defer statements.release(cached)
+
+	return cached.statement.QueryContext(ctx, args...)
+}
+
+// queryRowContext is execContext for queries returning one row.
+func queryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	defer logSlowQuery(query, time.Now())
+
+	db := getDB()
+	if config.StatementCacheSize <= 0 {
+		return db.QueryRowContext(ctx, query, args...)
+	}
+
+	cached, err := statements.prepare(ctx, db, query, config.StatementCacheSize)
+	if err != nil {
+		// sql.Row can't be made with an error, the uncached query fails the same way and reports it on Scan
+		return db.QueryRowContext(ctx, query, args...)
+	}
+	defer statements.release(cached)
+
+	return cached.statement.QueryRowContext(ctx, args...)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestStatementCacheReusesStatements(t *testing.T) {
+	db := openTestDB(t)
+	cache := newStatementCache()
+
+	first, err := cache.prepare(context.Background(), db, "select 1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.release(first)
+	second, err := cache.prepare(context.Background(), db, "select 1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.release(second)
+
+	if first.statement != second.statement {
+		t.Fatal("the same query was prepared twice")
+	}
+}
+
+func TestStatementCacheEvictsAndClosesLeastRecentlyUsed(t *testing.T) {
+	db := openTestDB(t)
+	cache := newStatementCache()
+
+	prepare := func(query string) *cachedStatement {
+		t.Helper()
+		cached, err := cache.prepare(context.Background(), db, query, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.release(cached)
+		return cached
+	}
+
+	one := prepare("select 1")
+	prepare("select 2")
+	prepare("select 1")
+	// "select 2" is the least recently used one now
+	prepare("select 3")
+
+	if cache.order.Len() != 2 {
+		t.Fatalf("got %d cached statements, want 2", cache.order.Len())
+	}
+	if _, ok := cache.entries["select 2"]; ok {
+		t.Fatal("the least recently used statement was kept")
+	}
+	if _, ok := cache.entries["select 1"]; !ok {
+		t.Fatal("a recently used statement was evicted")
+	}
+	if one != prepare("select 1") {
+		t.Fatal("a cached statement was prepared again")
+	}
+
+	three := cache.entries["select 3"].Value.(*cachedStatement)
+	prepare("select 4")
+	prepare("select 5")
+	if _, err := three.statement.Exec(); err == nil {
+		t.Fatal("expected the evicted statement to be closed")
+	}
+}
+
+func TestStatementCacheKeepsStatementInUseOpen(t *testing.T) {
+	db := openTestDB(t)
+	cache := newStatementCache()
+
+	inUse, err := cache.prepare(context.Background(), db, "select 1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cache.prepare(context.Background(), db, "select 2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.release(other)
+
+	// Evicted, but not closed while it is used
+	var n int
+	err = inUse.statement.QueryRow().Scan(&n)
+	if err != nil {
+		t.Fatalf("the evicted statement was closed while in use: %v", err)
+	}
+
+	cache.release(inUse)
+	if _, err := inUse.statement.Exec(); err == nil {
+		t.Fatal("expected the evicted statement to be closed once released")
+	}
+}
+
+// Run with -race.
+func TestStatementCacheConcurrentQueries(t *testing.T) {
+	openTestDB(t)
+	c := config
+	c.StatementCacheSize = 3
+	withConfig(t, c)
+	previous := statements
+	statements = newStatementCache()
+	t.Cleanup(func() { statements = previous })
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				var n int
+				// More distinct queries than the cache holds, so statements are evicted all the time
+				err := queryRowContext(context.Background(), fmt.Sprintf("select %d", i%7)).Scan(&n)
+				if err != nil || n != i%7 {
+					t.Errorf("got %d, %v for select %d", n, err, i%7)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if statements.order.Len() > 3 {
+		t.Fatalf("got %d cached statements, want at most 3", statements.order.Len())
+	}
+}
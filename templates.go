@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+// *********************************************************
+// Page templates
+// *********************************************************
+
+// pageTemplates holds every .html file of the ui, named by its path, e.g. "errors/500.html". It is parsed once by
+// startup(), so a broken page stops the app from starting instead of failing its first request.
+var pageTemplates *template.Template
+
+// loadTemplates parses all .html files in files.
+func loadTemplates(files fs.FS) (*template.Template, error) {
+	templates := template.New("")
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || path.Ext(name) != ".html" {
+			return nil
+		}
+
+		text, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		_, err = templates.New(name).Parse(string(text))
+		if err != nil {
+			return fmt.Errorf("could not parse template %s: %w", name, err)
+		}
+
+		return nil
+	})
+
+	return templates, err
+}
+
+// renderPage executes a page template. It is rendered into a buffer first, so a failing template still results in
+// a clean 500.
+func renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	var buffer bytes.Buffer
+	err := pageTemplates.ExecuteTemplate(&buffer, name, data)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not render page " + name)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buffer.Bytes())
+}
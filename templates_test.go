@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadTemplatesFailsOnABrokenTemplate(t *testing.T) {
+	_, err := loadTemplates(fstest.MapFS{
+		"index.html":            {Data: []byte("<p>{{.Greeting}}</p>")},
+		"pages/helloworld.html": {Data: []byte("<p>{{.Greeting</p>")},
+	})
+	if err == nil || !strings.Contains(err.Error(), "pages/helloworld.html") {
+		t.Fatalf("got %v, want an error naming the broken template", err)
+	}
+}
+
+func TestStartupFailsOnABrokenTemplate(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range requiredUIFiles {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), []byte("<p>{{if}}</p>"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := config
+	c.StaticDir = dir
+	withConfig(t, c)
+	previous := pageTemplates
+	t.Cleanup(func() { pageTemplates = previous })
+
+	err := startup()
+	if err == nil || !strings.Contains(err.Error(), "could not parse template") {
+		t.Fatalf("got %v, want startup to fail on the broken template", err)
+	}
+}
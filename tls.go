@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *********************************************************
+// TLS
+// *********************************************************
+
+// tlsConfig is built from the -tls-* flags by validateConfig. It is nil when the server runs plain http.
+var tlsConfig *tls.Config
+
+var curvesByName = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// buildTLSConfig returns nil when no certificate is configured. With -acme-domains the certificates come from
+// acmeManager, which has to be set up first. Cipher suites only apply to TLS 1.2, the TLS 1.3 suites can't be changed
+// in Go.
+func buildTLSConfig(c Config) (*tls.Config, error) {
+	useACME := len(c.ACMEDomains) > 0
+	if c.TLSCert == "" && c.TLSKey == "" && !useACME {
+		if len(c.TLSCipherSuites) > 0 || len(c.TLSCurves) > 0 {
+			return nil, fmt.Errorf("-tls-ciphers and -tls-curves need -tls-cert and -tls-key, or -acme-domains")
+		}
+		return nil, nil
+	}
+	if !useACME && (c.TLSCert == "" || c.TLSKey == "") {
+		return nil, fmt.Errorf("-tls-cert and -tls-key have to be set together")
+	}
+
+	settings := &tls.Config{MinVersion: tls.VersionTLS12}
+	if useACME {
+		// Also answers the TLS-ALPN-01 challenge
+		settings = acmeManager.TLSConfig()
+		settings.MinVersion = tls.VersionTLS12
+	}
+
+	for _, name := range c.TLSCipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		settings.CipherSuites = append(settings.CipherSuites, id)
+	}
+
+	for _, name := range c.TLSCurves {
+		id, ok := curvesByName[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q, use X25519, P256, P384 or P521", name)
+		}
+		settings.CurvePreferences = append(settings.CurvePreferences, id)
+	}
+
+	return settings, nil
+}
+
+// cipherSuiteID looks a name up in the cipher suites Go considers secure, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// hstsMiddleware tells browsers to only use https for this host. It is only sent on TLS responses, browsers ignore it
+// over plain http anyway. A maxAge of 0 turns it off.
+func hstsMiddleware(maxAge time.Duration, includeSubDomains bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if maxAge <= 0 {
+			return next
+		}
+
+		value := "max-age=" + strconv.FormatInt(int64(maxAge.Seconds()), 10)
+		if includeSubDomains {
+			value += "; includeSubDomains"
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
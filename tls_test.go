@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHSTSOnlyOnTLS(t *testing.T) {
+	handler := hstsMiddleware(time.Hour, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// httptest fills in r.TLS for https targets
+	w := serve(handler, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	if value := w.Header().Get("Strict-Transport-Security"); value != "max-age=3600; includeSubDomains" {
+		t.Errorf("got Strict-Transport-Security %q over https", value)
+	}
+
+	w = serve(handler, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if value := w.Header().Get("Strict-Transport-Security"); value != "" {
+		t.Errorf("got Strict-Transport-Security %q over http", value)
+	}
+
+	handler = hstsMiddleware(0, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w = serve(handler, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	if value := w.Header().Get("Strict-Transport-Security"); value != "" {
+		t.Errorf("got Strict-Transport-Security %q with a max-age of 0", value)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// *********************************************************
+// Outbound webhooks
+// *********************************************************
+
+type webhookDelivery struct {
+	url   string
+	event Event
+}
+
+// webhookDispatcher POSTs events to the -webhook-urls from a pool of workers, retrying failed deliveries with a
+// doubling backoff.
+type webhookDispatcher struct {
+	urls     []string
+	breakers map[string]*circuitBreaker
+	// queue makes deliveries wait for an open breaker instead of dropping them
+	queue   bool
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	jobs    chan webhookDelivery
+	readers sync.WaitGroup
+	workers sync.WaitGroup
+	// stopped is done once Drain runs out of time, the deliveries still queued are then dropped
+	stopped context.Context
+	stop    context.CancelFunc
+	dropped uint64
+}
+
+// startWebhookDispatcher delivers the events from the subscriptions until all of them are closed.
+func startWebhookDispatcher(subscriptions []<-chan Event, urls []string, workers int) *webhookDispatcher {
+	d := &webhookDispatcher{
+		urls:     urls,
+		breakers: make(map[string]*circuitBreaker, len(urls)),
+		queue:    config.WebhookBreakerQueue,
+		client:   &http.Client{Timeout: config.WebhookTimeout},
+		retries:  config.WebhookRetries,
+		backoff:  config.WebhookBackoff,
+		jobs:     make(chan webhookDelivery, config.EventBuffer),
+	}
+	d.stopped, d.stop = context.WithCancel(context.Background())
+
+	for _, url := range urls {
+		d.breakers[url] = &circuitBreaker{threshold: config.WebhookBreakerFailures, cooldown: config.WebhookBreakerCooldown}
+	}
+
+	for _, subscription := range subscriptions {
+		d.readers.Add(1)
+		go d.read(subscription)
+	}
+	go func() {
+		d.readers.Wait()
+		close(d.jobs)
+	}()
+
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		d.workers.Add(1)
+		go d.work()
+	}
+
+	return d
+}
+
+func (d *webhookDispatcher) read(subscription <-chan Event) {
+	defer d.readers.Done()
+	for event := range subscription {
+		for _, url := range d.urls {
+			select {
+			case d.jobs <- webhookDelivery{url: url, event: event}:
+			case <-d.stopped.Done():
+				atomic.AddUint64(&d.dropped, 1)
+			}
+		}
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	defer d.workers.Done()
+	for delivery := range d.jobs {
+		if d.stopped.Err() != nil {
+			atomic.AddUint64(&d.dropped, 1)
+			continue
+		}
+		d.deliver(delivery)
+	}
+}
+
+// Wait blocks until every queued delivery has been attempted. It returns once the event bus is closed.
+func (d *webhookDispatcher) Wait() {
+	d.workers.Wait()
+}
+
+// Drain waits up to timeout, or until ctx is done, for the queued deliveries to be attempted. It returns once the
+// event bus is closed. Deliveries still queued or waiting for a retry after that are dropped and counted in the
+// error.
+func (d *webhookDispatcher) Drain(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		d.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Workers stop retrying and skip the rest of the queue, posts in flight are canceled
+	d.stop()
+	<-done
+	dropped := atomic.LoadUint64(&d.dropped)
+	log.Warn().Uint64("dropped", dropped).Msg("Webhook deliveries still queued at shutdown were dropped")
+
+	return fmt.Errorf("webhook deliveries did not finish within %s, dropped %d", timeout, dropped)
+}
+
+// sleep waits for the duration and reports false when Drain stopped the dispatcher in the meantime.
+func (d *webhookDispatcher) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-d.stopped.Done():
+		return false
+	}
+}
+
+func (d *webhookDispatcher) deliver(delivery webhookDelivery) {
+	body, err := json.Marshal(delivery.event)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not encode webhook event " + delivery.event.Topic)
+		return
+	}
+
+	breaker := d.breakers[delivery.url]
+	backoff := d.backoff
+	for attempt := 0; ; attempt++ {
+		for {
+			allowed, wait := breaker.allow(time.Now())
+			if allowed {
+				break
+			}
+			if !d.queue {
+				log.Warn().Str("url", delivery.url).Msg("Webhook circuit breaker is open, dropping event " + delivery.event.Topic)
+				return
+			}
+			if !d.sleep(wait) {
+				atomic.AddUint64(&d.dropped, 1)
+				return
+			}
+		}
+
+		err = d.post(delivery.url, body)
+		if d.stopped.Err() != nil {
+			// Canceled by Drain, the URL didn't fail
+			atomic.AddUint64(&d.dropped, 1)
+			return
+		}
+		if breaker.record(err == nil, time.Now()) {
+			log.Warn().Str("url", delivery.url).Msg("Webhook circuit breaker opened for " + config.WebhookBreakerCooldown.String())
+		}
+		if err == nil {
+			log.Debug().Str("url", delivery.url).Msg("Delivered webhook event " + delivery.event.Topic)
+			return
+		}
+		if attempt >= d.retries {
+			break
+		}
+
+		log.Warn().Err(err).Str("url", delivery.url).Msg("Webhook delivery failed, retrying in " + backoff.String())
+		if !d.sleep(backoff) {
+			atomic.AddUint64(&d.dropped, 1)
+			return
+		}
+		backoff *= 2
+	}
+
+	log.Error().Err(err).Str("url", delivery.url).Int("attempts", d.retries+1).Msg("Giving up on webhook event " + delivery.event.Topic)
+}
+
+func (d *webhookDispatcher) post(url string, body []byte) error {
+	request, err := http.NewRequestWithContext(d.stopped, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+
+	return nil
+}
+
+// circuitBreaker stops deliveries to a webhook URL after threshold consecutive failures. Once the cooldown has passed
+// one trial delivery is let through (half-open). The breaker closes when it succeeds and opens again when it fails.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+// allow reports whether a delivery may be attempted, and otherwise how long to wait before asking again.
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true, 0
+	}
+
+	wait := b.openedAt.Add(b.cooldown).Sub(now)
+	if wait > 0 {
+		return false, wait
+	}
+	if b.trial {
+		// Another delivery is already trying the URL
+		return false, b.cooldown
+	}
+
+	b.trial = true
+	return true, 0
+}
+
+// record counts the outcome of a delivery attempt and reports whether it opened the breaker.
+func (b *circuitBreaker) record(success bool, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+	if success {
+		b.failures = 0
+		return false
+	}
+
+	b.failures++
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return false
+	}
+
+	b.openedAt = now
+	return true
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withWebhookConfig makes deliveries fast enough for tests: short backoff and no circuit breaker unless the test sets
+// one.
+func withWebhookConfig(t *testing.T) {
+	t.Helper()
+
+	c := config
+	c.WebhookTimeout = time.Second
+	c.WebhookRetries = 2
+	c.WebhookBackoff = time.Millisecond
+	c.WebhookBreakerFailures = 0
+	c.WebhookBreakerQueue = false
+	c.EventBuffer = 16
+	withConfig(t, c)
+}
+
+// webhookReceiver counts the posts it gets and answers the first failures of them with a 500.
+type webhookReceiver struct {
+	mutex    sync.Mutex
+	failures int
+	events   []Event
+	attempts int
+}
+
+func (h *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.attempts++
+	if h.attempts <= h.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var event Event
+	err := json.NewDecoder(r.Body).Decode(&event)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.events = append(h.events, event)
+}
+
+func (h *webhookReceiver) counts() (int, int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.attempts, len(h.events)
+}
+
+func TestWebhookDelivered(t *testing.T) {
+	withWebhookConfig(t)
+	receiver := &webhookReceiver{}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+
+	bus := NewEventBus(config.EventBuffer)
+	dispatcher := startWebhookDispatcher([]<-chan Event{bus.Subscribe(allTopics)}, []string{target.URL}, 2)
+	bus.Publish("flag.updated", FeatureFlag{Name: "new-greeting", Enabled: true})
+	bus.Close()
+	dispatcher.Wait()
+
+	attempts, delivered := receiver.counts()
+	if attempts != 1 || delivered != 1 {
+		t.Fatalf("got %d attempts and %d deliveries, want 1 and 1", attempts, delivered)
+	}
+	if receiver.events[0].Topic != "flag.updated" {
+		t.Fatalf("got topic %q", receiver.events[0].Topic)
+	}
+}
+
+func TestWebhookRetriesFailedDeliveries(t *testing.T) {
+	withWebhookConfig(t)
+	receiver := &webhookReceiver{failures: 2}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+
+	bus := NewEventBus(config.EventBuffer)
+	dispatcher := startWebhookDispatcher([]<-chan Event{bus.Subscribe(allTopics)}, []string{target.URL}, 1)
+	bus.Publish("flag.updated", FeatureFlag{Name: "new-greeting"})
+	bus.Close()
+	dispatcher.Wait()
+
+	attempts, delivered := receiver.counts()
+	if attempts != 3 || delivered != 1 {
+		t.Fatalf("got %d attempts and %d deliveries, want 3 and 1", attempts, delivered)
+	}
+}
+
+func TestWebhookGivesUpAfterRetries(t *testing.T) {
+	withWebhookConfig(t)
+	log := captureLog(t)
+	receiver := &webhookReceiver{failures: 10}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+
+	bus := NewEventBus(config.EventBuffer)
+	dispatcher := startWebhookDispatcher([]<-chan Event{bus.Subscribe(allTopics)}, []string{target.URL}, 1)
+	bus.Publish("flag.updated", FeatureFlag{Name: "new-greeting"})
+	bus.Close()
+	dispatcher.Wait()
+
+	attempts, delivered := receiver.counts()
+	if attempts != config.WebhookRetries+1 || delivered != 0 {
+		t.Fatalf("got %d attempts and %d deliveries, want %d and 0", attempts, delivered, config.WebhookRetries+1)
+	}
+	if !bytes.Contains(log.Bytes(), []byte("Giving up on webhook event flag.updated")) {
+		t.Fatalf("failed delivery not logged: %s", log.String())
+	}
+}
+
+func TestCircuitBreakerSkipsDeliveriesWhileOpen(t *testing.T) {
+	withWebhookConfig(t)
+	config.WebhookRetries = 0
+	config.WebhookBreakerFailures = 2
+	config.WebhookBreakerCooldown = time.Hour
+	receiver := &webhookReceiver{failures: 100}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+
+	bus := NewEventBus(config.EventBuffer)
+	dispatcher := startWebhookDispatcher([]<-chan Event{bus.Subscribe(allTopics)}, []string{target.URL}, 1)
+	for i := 0; i < 5; i++ {
+		bus.Publish("flag.updated", FeatureFlag{Name: "new-greeting"})
+	}
+	bus.Close()
+	dispatcher.Wait()
+
+	if attempts, _ := receiver.counts(); attempts != 2 {
+		t.Fatalf("got %d attempts, want the breaker to open after 2", attempts)
+	}
+}
+
+func TestCircuitBreakerHalfOpensAfterCooldown(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 2, cooldown: time.Minute}
+	now := time.Now()
+
+	breaker.record(false, now)
+	if !breaker.record(false, now) {
+		t.Fatal("expected the second failure to open the breaker")
+	}
+	if allowed, wait := breaker.allow(now.Add(time.Second)); allowed || wait != 59*time.Second {
+		t.Fatalf("got allowed %v waiting %s during the cooldown", allowed, wait)
+	}
+
+	// One trial delivery after the cooldown, the others wait for its outcome
+	later := now.Add(time.Minute)
+	if allowed, _ := breaker.allow(later); !allowed {
+		t.Fatal("expected a trial delivery after the cooldown")
+	}
+	if allowed, _ := breaker.allow(later); allowed {
+		t.Fatal("expected only one trial delivery")
+	}
+
+	breaker.record(true, later)
+	if allowed, _ := breaker.allow(later); !allowed {
+		t.Fatal("expected a successful trial to close the breaker")
+	}
+}
+
+func TestWebhookDrainFinishesQueuedDeliveries(t *testing.T) {
+	withWebhookConfig(t)
+	receiver := &webhookReceiver{failures: 1}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+
+	bus := NewEventBus(config.EventBuffer)
+	dispatcher := startWebhookDispatcher([]<-chan Event{bus.Subscribe(allTopics)}, []string{target.URL}, 1)
+	bus.Publish("flag.updated", FeatureFlag{Name: "new-greeting", Enabled: true})
+	bus.Publish("flag.updated", FeatureFlag{Name: "new-greeting", Enabled: false})
+	bus.Close()
+
+	err := dispatcher.Drain(context.Background(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, delivered := receiver.counts(); delivered != 2 {
+		t.Fatalf("got %d deliveries, want 2", delivered)
+	}
+}
+
+func TestWebhookDrainDropsAfterTimeout(t *testing.T) {
+	withWebhookConfig(t)
+	logs := captureLog(t)
+	// Doesn't answer until the test ends, so the first delivery stays in flight and the rest stay queued
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	bus := NewEventBus(config.EventBuffer)
+	dispatcher := startWebhookDispatcher([]<-chan Event{bus.Subscribe(allTopics)}, []string{target.URL}, 1)
+	for i := 0; i < 3; i++ {
+		bus.Publish("flag.updated", FeatureFlag{Name: "new-greeting", Enabled: true})
+	}
+	bus.Close()
+
+	start := time.Now()
+	err := dispatcher.Drain(context.Background(), 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected Drain to time out")
+	}
+	if elapsed := time.Since(start); elapsed > config.WebhookTimeout {
+		t.Fatalf("Drain took %s, want it to stop at the timeout", elapsed)
+	}
+	if dropped := atomic.LoadUint64(&dispatcher.dropped); dropped != 3 {
+		t.Fatalf("got %d dropped deliveries, want 3", dropped)
+	}
+	if !strings.Contains(logs.String(), "dropped") {
+		t.Fatalf("expected the drops to be logged: %s", logs.String())
+	}
+}